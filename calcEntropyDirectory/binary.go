@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+)
+
+// The entropy of a PE or ELF file is mostly the entropy of its sections, a packed or encrypted payload raises the
+// entropy of one section while the headers and the other sections keep the file below High
+// Each section is rated on its own and the data after the last section (overlay) is evaluated separately
+
+const (
+	packedEntropy      = 7.0  // A section with a higher entropy is compressed or encrypted
+	minPackedSize      = 1024 // Smaller sections are too short for the entropy to mean anything
+	peSecurityDirEntry = 4    // IMAGE_DIRECTORY_ENTRY_SECURITY, the Authenticode signature is appended after the sections
+	peSymbolSize       = 18   // Size of a COFF symbol, the string table follows the last symbol
+)
+
+// Section names written by common packers and protectors
+var packerSections = []string{"UPX0", "UPX1", "UPX2", ".aspack", ".adata", ".MPRESS1", ".MPRESS2", ".petite", ".nsp0", ".nsp1", ".packed", ".themida", ".vmp0", ".vmp1", ".enigma1", ".enigma2"}
+
+type SectionEntropy struct {
+	Name          string
+	Offset        int64
+	Size          int64
+	Entropy       float64
+	EntropyRating string
+	Executable    bool
+	Packed        bool
+}
+
+type BinaryProfile struct {
+	Format         string // PE or ELF
+	Sections       []SectionEntropy
+	PackedSections int
+	OverlayOffset  int64   `json:",omitempty"`
+	OverlaySize    int64   `json:",omitempty"`
+	OverlayEntropy float64 `json:",omitempty"`
+	OverlayRating  string  `json:",omitempty"`
+}
+
+// roundEntropy keeps 4 decimals, the same precision as the CSV, so the chunk series does not make the JSON output huge
+func roundEntropy(entropy float64) float64 {
+	return math.Round(entropy*10000) / 10000
+}
+
+// readerEntropy calculates the entropy of size bytes at offset
+func readerEntropy(r io.ReaderAt, offset int64, size int64) (float64, error) {
+	counter := &byteCounter{}
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	if _, err := io.CopyBuffer(counter, io.NewSectionReader(r, offset, size), *buffer); err != nil {
+		return 0, err
+	}
+	if counter.total == 0 {
+		return 0, nil
+	}
+	return entropyFromCounts(&counter.counts, counter.total), nil
+}
+
+func isPackerSection(name string) bool {
+	for _, packer := range packerSections {
+		if strings.EqualFold(name, packer) {
+			return true
+		}
+	}
+	return false
+}
+
+// newSection rates the section, a section is packed when a packer named it or the data is compressed or encrypted
+// Debug information compressed by the compiler (.zdebug_* and SHF_COMPRESSED sections) is not packed
+func newSection(r io.ReaderAt, name string, offset int64, size int64, executable bool, compressed bool) (SectionEntropy, error) {
+	s := SectionEntropy{Name: name, Offset: offset, Size: size, Executable: executable}
+	entropy, err := readerEntropy(r, offset, size)
+	if err != nil {
+		return s, err
+	}
+	s.Entropy = roundEntropy(entropy)
+	s.EntropyRating = entropyRating(entropy)
+	s.Packed = isPackerSection(name) || (entropy > packedEntropy && size >= minPackedSize && !compressed)
+	return s, nil
+}
+
+// ProfileBinary returns the section entropy of a PE or ELF file, nil for other files or when the headers cannot be parsed
+func ProfileBinary(r io.ReaderAt, head []byte, fileSize int64) *BinaryProfile {
+	var profile *BinaryProfile
+	var err error
+	if bytes.HasPrefix(head, []byte("MZ")) {
+		profile, err = profilePE(r, fileSize)
+	} else if bytes.HasPrefix(head, []byte(elf.ELFMAG)) {
+		profile, err = profileELF(r, head, fileSize)
+	}
+	if err != nil || profile == nil {
+		return nil
+	}
+
+	for _, s := range profile.Sections {
+		if s.Packed {
+			profile.PackedSections++
+		}
+	}
+	if profile.OverlayOffset > 0 && profile.OverlayOffset < fileSize {
+		profile.OverlaySize = fileSize - profile.OverlayOffset
+		entropy, err := readerEntropy(r, profile.OverlayOffset, profile.OverlaySize)
+		if err == nil {
+			profile.OverlayEntropy = roundEntropy(entropy)
+			profile.OverlayRating = entropyRating(entropy)
+		}
+	} else {
+		profile.OverlayOffset = 0
+	}
+	return profile
+}
+
+func profilePE(r io.ReaderAt, fileSize int64) (*BinaryProfile, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	profile := &BinaryProfile{Format: "PE"}
+	var end int64
+	for _, section := range f.Sections {
+		offset, size := int64(section.Offset), int64(section.Size)
+		// UPX0 and .bss have no data in the file, a truncated file has part of the section
+		if offset+size > fileSize {
+			size = max(fileSize-offset, 0)
+		}
+		s, err := newSection(r, section.Name, offset, size, section.Characteristics&pe.IMAGE_SCN_MEM_EXECUTE != 0, strings.HasPrefix(section.Name, ".zdebug"))
+		if err != nil {
+			return nil, err
+		}
+		profile.Sections = append(profile.Sections, s)
+		end = max(end, offset+size)
+	}
+
+	// The COFF symbols and string table of mingw and unstripped binaries are after the sections, they are not an overlay
+	if symbols := int64(f.FileHeader.PointerToSymbolTable); symbols > 0 && symbols < fileSize {
+		symbolsEnd := symbols + peSymbolSize*int64(f.FileHeader.NumberOfSymbols)
+		var stringsSize [4]byte
+		if _, err := r.ReadAt(stringsSize[:], symbolsEnd); err == nil {
+			// The size of the string table includes the 4 bytes of the size
+			if size := int64(binary.LittleEndian.Uint32(stringsSize[:])); size >= 4 && symbolsEnd+size <= fileSize {
+				symbolsEnd += size
+			}
+		}
+		end = max(end, min(symbolsEnd, fileSize))
+	}
+
+	// The signature is not an overlay, the data after it is, the signature is aligned to 8 bytes
+	var security pe.DataDirectory
+	switch header := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		security = header.DataDirectory[peSecurityDirEntry]
+	case *pe.OptionalHeader64:
+		security = header.DataDirectory[peSecurityDirEntry]
+	}
+	if offset := int64(security.VirtualAddress); security.Size > 0 && offset >= end && offset-end < 8 {
+		end = offset + int64(security.Size)
+	}
+	profile.OverlayOffset = end
+	return profile, nil
+}
+
+func profileELF(r io.ReaderAt, head []byte, fileSize int64) (*BinaryProfile, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	profile := &BinaryProfile{Format: "ELF"}
+	var end int64
+	for _, section := range f.Sections {
+		if section.Type == elf.SHT_NULL {
+			continue
+		}
+		offset, size := int64(section.Offset), int64(section.FileSize)
+		if section.Type == elf.SHT_NOBITS {
+			size = 0
+		} else if offset+size > fileSize {
+			size = max(fileSize-offset, 0)
+		}
+		s, err := newSection(r, section.Name, offset, size, section.Flags&elf.SHF_EXECINSTR != 0, section.Flags&elf.SHF_COMPRESSED != 0 || strings.HasPrefix(section.Name, ".zdebug"))
+		if err != nil {
+			return nil, err
+		}
+		profile.Sections = append(profile.Sections, s)
+		end = max(end, offset+size)
+	}
+	for _, prog := range f.Progs {
+		end = max(end, int64(prog.Off+prog.Filesz))
+	}
+
+	// The section header table is usually the last part of the file, debug/elf does not return where it is
+	var shoff int64
+	var shentsize, shnum uint16
+	if f.Class == elf.ELFCLASS64 && len(head) >= 64 {
+		shoff = int64(f.ByteOrder.Uint64(head[0x28:]))
+		shentsize, shnum = f.ByteOrder.Uint16(head[0x3A:]), f.ByteOrder.Uint16(head[0x3C:])
+	} else if f.Class == elf.ELFCLASS32 && len(head) >= 52 {
+		shoff = int64(f.ByteOrder.Uint32(head[0x20:]))
+		shentsize, shnum = f.ByteOrder.Uint16(head[0x2E:]), f.ByteOrder.Uint16(head[0x30:])
+	}
+	end = max(end, shoff+int64(shentsize)*int64(shnum))
+	profile.OverlayOffset = end
+	return profile, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A JSON output is a snapshot of the directory, a later snapshot or a live scan is compared with it
+// The files are matched by the path relative to the BaseDir, so a snapshot of a copy or a mounted image can be compared with the original
+// Files that were added, removed or have a different SHA256 are reported, with the entropy rating before and after
+
+type FileChange struct {
+	Change      string // Added, Removed or Modified
+	FilePath    string // Relative to the BaseDir
+	OldSize     int64
+	NewSize     int64
+	OldSHA256   string
+	NewSHA256   string
+	OldEntropy  float64
+	NewEntropy  float64
+	OldRating   string
+	NewRating   string
+	RatingShift string // e.g. "Low to High", empty when the rating did not change
+}
+
+type CompareStruct struct {
+	Baseline      string
+	Current       string
+	Created       string
+	Added         int
+	Removed       int
+	Modified      int
+	RatingChanged int
+	RatingShifts  map[string]int // Number of files for each shift, e.g. "Low to High": 12
+	Changes       []FileChange
+}
+
+// LoadSnapshot reads a JSON output created by CreateJSONFile
+func LoadSnapshot(f string) (EntropyStructs, error) {
+	var e EntropyStructs
+	snapshotFile, err := os.Open(f)
+	if err != nil {
+		return e, err
+	}
+	defer snapshotFile.Close()
+	if err := json.NewDecoder(snapshotFile).Decode(&e); err != nil {
+		return e, fmt.Errorf("%s is not a JSON output of calcEntropyDirectory: %v", f, err)
+	}
+	return e, nil
+}
+
+// relativeFiles returns the files of the snapshot by the path relative to the BaseDir
+func (e *EntropyStructs) relativeFiles() map[string]EntropyFile {
+	files := make(map[string]EntropyFile)
+	for _, eFile := range e.EntropyFiles {
+		relPath, err := filepath.Rel(e.BaseDir, eFile.FilePath)
+		if err != nil {
+			relPath = eFile.FilePath
+		}
+		files[filepath.ToSlash(relPath)] = eFile
+	}
+	return files
+}
+
+// CompareSnapshots reports the changes from the baseline to the current snapshot
+func CompareSnapshots(baseline EntropyStructs, current EntropyStructs) CompareStruct {
+	c := CompareStruct{
+		Baseline:     baseline.BaseDir,
+		Current:      current.BaseDir,
+		Created:      time.Now().Format(time.RFC3339),
+		RatingShifts: make(map[string]int),
+	}
+	oldFiles := baseline.relativeFiles()
+	newFiles := current.relativeFiles()
+
+	for relPath, newFile := range newFiles {
+		oldFile, found := oldFiles[relPath]
+		if !found {
+			c.Added++
+			c.Changes = append(c.Changes, FileChange{Change: "Added", FilePath: relPath, NewSize: newFile.FileSize, NewSHA256: newFile.SHA256, NewEntropy: newFile.Entropy, NewRating: newFile.EntropyRating})
+			continue
+		}
+		// A file that could not be read has no hash, it is only reported when the rating changed
+		if oldFile.SHA256 == newFile.SHA256 && oldFile.EntropyRating == newFile.EntropyRating {
+			continue
+		}
+		change := FileChange{
+			Change:     "Modified",
+			FilePath:   relPath,
+			OldSize:    oldFile.FileSize,
+			NewSize:    newFile.FileSize,
+			OldSHA256:  oldFile.SHA256,
+			NewSHA256:  newFile.SHA256,
+			OldEntropy: oldFile.Entropy,
+			NewEntropy: newFile.Entropy,
+			OldRating:  oldFile.EntropyRating,
+			NewRating:  newFile.EntropyRating,
+		}
+		c.Modified++
+		if oldFile.EntropyRating != newFile.EntropyRating {
+			change.RatingShift = oldFile.EntropyRating + " to " + newFile.EntropyRating
+			c.RatingChanged++
+			c.RatingShifts[change.RatingShift]++
+		}
+		c.Changes = append(c.Changes, change)
+	}
+	for relPath, oldFile := range oldFiles {
+		if _, found := newFiles[relPath]; !found {
+			c.Removed++
+			c.Changes = append(c.Changes, FileChange{Change: "Removed", FilePath: relPath, OldSize: oldFile.FileSize, OldSHA256: oldFile.SHA256, OldEntropy: oldFile.Entropy, OldRating: oldFile.EntropyRating})
+		}
+	}
+
+	sort.Slice(c.Changes, func(i, j int) bool {
+		if c.Changes[i].FilePath != c.Changes[j].FilePath {
+			return c.Changes[i].FilePath < c.Changes[j].FilePath
+		}
+		return c.Changes[i].Change < c.Changes[j].Change
+	})
+	return c
+}
+
+// PrintSummary lists the counts and the files whose rating shifted, a shift to High is what encrypted files look like
+func (c *CompareStruct) PrintSummary() {
+	fmt.Printf("[*] Compared %s with %s\n", c.Baseline, c.Current)
+	fmt.Printf("[*] Added: %d  Removed: %d  Modified: %d  Rating changed: %d\n", c.Added, c.Removed, c.Modified, c.RatingChanged)
+
+	shifts := make([]string, 0, len(c.RatingShifts))
+	for shift := range c.RatingShifts {
+		shifts = append(shifts, shift)
+	}
+	sort.Strings(shifts)
+	for _, shift := range shifts {
+		fmt.Printf("    %-18s %d\n", shift, c.RatingShifts[shift])
+	}
+	for _, change := range c.Changes {
+		if change.RatingShift != "" {
+			fmt.Printf("[!] %s %s (%.4f -> %.4f)\n", change.FilePath, change.RatingShift, change.OldEntropy, change.NewEntropy)
+		}
+	}
+}
+
+func (c *CompareStruct) CreateJSONFile(f string) error {
+	jsonData, err := json.MarshalIndent(c, "", "   ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f+".json", jsonData, 0644)
+}
+
+func (c *CompareStruct) CreatCSVFile(f string) error {
+	file, err := os.Create(f + ".csv")
+	if err != nil {
+		return fmt.Errorf("failed to create the csv file: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	header := []string{"Change",
+		"FilePath",
+		"OldSize",
+		"NewSize",
+		"OldSHA256",
+		"NewSHA256",
+		"OldEntropy",
+		"NewEntropy",
+		"OldRating",
+		"NewRating",
+		"RatingShift",
+	}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("writing the csv header failed: %v", err)
+	}
+	for _, change := range c.Changes {
+		record := []string{
+			change.Change,
+			change.FilePath,
+			strconv.FormatInt(change.OldSize, 10),
+			strconv.FormatInt(change.NewSize, 10),
+			change.OldSHA256,
+			change.NewSHA256,
+			fmt.Sprintf("%.4f", change.OldEntropy),
+			fmt.Sprintf("%.4f", change.NewEntropy),
+			change.OldRating,
+			change.NewRating,
+			change.RatingShift,
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("writing the csv file failed: %v", err)
+		}
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -52,7 +53,8 @@ type EntropyStructs struct {
 	FileList     []string
 	EntropyFiles []EntropyFile
 	Debug        bool
-	MaxFileSize  int // Max file size to evaluate chunks
+	MaxFileSize  int      // Max file size to evaluate chunks
+	Rules        *RuleSet `json:"-"` // Rules matched against every file, nil without -rules
 }
 
 type EntropyFile struct {
@@ -73,6 +75,9 @@ type EntropyFile struct {
 	LowEntropyChunks    int
 	MediumEntropyChunks int
 	HighEntropyChunks   int
+	ChunkEntropy        []float64      `json:",omitempty"` // Entropy of every chunk, the offset of a chunk is its index * ChunkSize
+	Binary              *BinaryProfile `json:",omitempty"` // Entropy of the sections of a PE or ELF file
+	Rules               []string       `json:",omitempty"` // Names of the rules that matched the file
 }
 
 func (e *EntropyFile) CalculateEntropy(d []byte, selection string) error {
@@ -94,22 +99,15 @@ func (e *EntropyFile) CalculateEntropy(d []byte, selection string) error {
 		e.Entropy = entropy
 
 		// Calculate the rating of the Entropy
-		// Low Entropy <= 5.0
-		if entropy <= 5.0 {
-			e.EntropyRating = "Low"
-		} else if entropy > 6.5 {
-			e.EntropyRating = "High"
-		} else {
-			e.EntropyRating = "Medium"
-		}
+		e.EntropyRating = entropyRating(entropy)
 		return nil
 	} else if selection == "chunk" {
-		// Low Entropy <= 5.0
-		if entropy <= 5.0 {
+		switch entropyRating(entropy) {
+		case "Low":
 			e.LowEntropyChunks++
-		} else if entropy > 6.5 {
+		case "High":
 			e.HighEntropyChunks++
-		} else {
+		default:
 			e.MediumEntropyChunks++
 		}
 	}
@@ -208,6 +206,10 @@ func (e *EntropyStructs) CreatCSVFile(f string) error {
 		"LowEntropyChunks",
 		"MediumEntropyChunks",
 		"HighEntropyChunks",
+		"BinaryFormat",
+		"PackedSections",
+		"OverlaySize",
+		"Rules",
 	}
 	if err := writer.Write(header); err != nil {
 		return fmt.Errorf("writing the csv header failed: %v", err)
@@ -233,6 +235,15 @@ func (e *EntropyStructs) CreatCSVFile(f string) error {
 			strconv.Itoa(eFile.LowEntropyChunks),
 			strconv.Itoa(eFile.MediumEntropyChunks),
 			strconv.Itoa(eFile.HighEntropyChunks),
+			"",
+			"",
+			"",
+			strings.Join(eFile.Rules, " "),
+		}
+		if eFile.Binary != nil {
+			record[len(record)-4] = eFile.Binary.Format
+			record[len(record)-3] = strconv.Itoa(eFile.Binary.PackedSections)
+			record[len(record)-2] = strconv.FormatInt(eFile.Binary.OverlaySize, 10)
 		}
 		if err := writer.Write(record); err != nil {
 			return fmt.Errorf("writing the csv file failed: %v", err)
@@ -332,8 +343,25 @@ func main() {
 	maxDepthPtr := flag.Int("depth", -1, "Maximum recursion depth (0 for current directory only, -1 for unlimited)")
 	maxSizePtr := flag.Int("maxsize", 10, "Maximum size of file in MB to evaluate chunks")
 	debugPtr := flag.Bool("debug", false, "Enable Debug Information, creates a debug file")
+	workersPtr := flag.Int("workers", runtime.NumCPU(), "Number of files evaluated at the same time")
+	comparePtr := flag.String("compare", "", "Compare with this JSON output (baseline) and save the changes to <output>_changes")
+	toPtr := flag.String("to", "", "JSON output compared with the baseline, without it the directory is scanned and compared")
+	rulesPtr := flag.String("rules", "", "YARA rule file or directory of .yar files matched against every file")
+	ruleSizePtr := flag.Int("rulesize", 64, "Maximum size of file in MB to match the rules")
 	flag.Parse()
 
+	// The baseline is loaded before the scan, with the default -o the outputs of the scan replace the baseline file
+	var baseline EntropyStructs
+	if len(*comparePtr) > 0 {
+		baseline = loadSnapshot(*comparePtr, "baseline")
+	}
+
+	// Compare two JSON outputs without scanning
+	if len(*comparePtr) > 0 && len(*toPtr) > 0 {
+		compareSnapshot(baseline, *comparePtr, loadSnapshot(*toPtr, "snapshot"), *toPtr, *formatPtr, *outputPtr)
+		return
+	}
+
 	var eStruct EntropyStructs
 	//var eFile EntropyFile
 
@@ -343,6 +371,15 @@ func main() {
 	eStruct.Debug = *debugPtr
 	eStruct.MaxFileSize = *maxSizePtr * 1024 * 1024
 
+	if len(*rulesPtr) > 0 {
+		rules, err := LoadRules(*rulesPtr, *ruleSizePtr*1024*1024)
+		if err != nil {
+			log.Fatalf("[E] Unable to load the rules: %v\n", err)
+		}
+		Debug(fmt.Sprintf("Loaded %d rules from %s\n", len(rules.Rules), *rulesPtr), eStruct.Debug)
+		eStruct.Rules = rules
+	}
+
 	// Gather File list
 	baseDir := *directoryPtr
 	if len(baseDir) > 0 {
@@ -358,73 +395,8 @@ func main() {
 
 	Debug(fmt.Sprintf("Number of Files to be Evaluated: %d\n", len(eStruct.FileList)), eStruct.Debug)
 
-	// Iterate over the files in the file list
-	for _, f := range eStruct.FileList {
-		Debug(fmt.Sprintf("\nEvaluating the file: %s - %s\n", f, calcTime()), eStruct.Debug)
-		// Add information about a file to a struct
-		var eFile EntropyFile
-		eFile.AddFileInformation(f)
-
-		// Calculate the Hashes
-		Debug(fmt.Sprintf("- Calculating Hashes (MD5, SHA1, SHA256) - %s\n", calcTime()), eStruct.Debug)
-		err := eFile.CalculateHashes(f)
-		if err != nil {
-			log.Printf("[W] Calculating Hashes: %v", err)
-		}
-
-		if eFile.SHA256 == "" {
-			eFile.MIMEType = "Access is Denied"
-			eFile.EntropyRating = "None"
-		} else {
-
-			// Identify MIME Type of File
-			Debug(fmt.Sprintf("- Identifying the MIME Type - %s\n", calcTime()), eStruct.Debug)
-			err = eFile.IdentifyMIMEType(f)
-			if err != nil {
-				log.Printf("[W] Identifying the MIME Type: %v", err)
-			}
-
-			// Calculate Entropy of the File
-			file, err := os.Open(f)
-			if err != nil {
-				log.Println("Error opening file:", err)
-			}
-			defer file.Close()
-
-			data, err := io.ReadAll(file)
-			if err != nil {
-				log.Println("Error converting the file into a byte array")
-			}
-
-			Debug(fmt.Sprintf("- Calculating the Entropy of the File - %s\n", calcTime()), eStruct.Debug)
-			eFile.CalculateEntropy(data, "file")
-
-			// Calculate Entropy of Chunks
-			if eFile.FileSize < int64(eStruct.MaxFileSize) {
-				eFile.ChunksEvaluated = true
-				Debug(fmt.Sprintf("- Calculating the Entropy of the Chunks in the File - %s\n", calcTime()), eStruct.Debug)
-				eFile.LowEntropyChunks = 0
-				eFile.MediumEntropyChunks = 0
-				eFile.HighEntropyChunks = 0
-
-				for i := 0; i < len(data); i += eStruct.ChunkSize {
-					end := min(i+eStruct.ChunkSize, len(data))
-					chunk := data[i:end]
-					eFile.CalculateEntropy(chunk, "chunk")
-				}
-			} else {
-				Debug(fmt.Sprintf("- Skipped calculating the Entropy of the Chunks due to size of file is larger than maxsize - %s\n", calcTime()), eStruct.Debug)
-				eFile.ChunksEvaluated = false
-				eFile.LowEntropyChunks = 0
-				eFile.MediumEntropyChunks = 0
-				eFile.HighEntropyChunks = 0
-			}
-
-		}
-
-		// Append the information with the other structs
-		eStruct.EntropyFiles = append(eStruct.EntropyFiles, eFile)
-	}
+	// Each file is read once by one of the workers
+	eStruct.EvaluateFiles(*workersPtr)
 
 	if *formatPtr == "json" {
 		eStruct.CreateJSONFile(*outputPtr)
@@ -437,4 +409,38 @@ func main() {
 		// Output in csv the information collected
 		eStruct.CreatCSVFile(*outputPtr)
 	}
+
+	// Compare the scan with the baseline, the outputs above are the snapshot for the next run
+	if len(*comparePtr) > 0 {
+		compareSnapshot(baseline, *comparePtr, eStruct, *directoryPtr, *formatPtr, *outputPtr)
+	}
+}
+
+// loadSnapshot loads a JSON output to compare, name is the baseline or the snapshot in the error
+func loadSnapshot(f string, name string) EntropyStructs {
+	snapshot, err := LoadSnapshot(f)
+	if err != nil {
+		log.Fatalf("[E] Unable to load the %s: %v\n", name, err)
+	}
+	return snapshot
+}
+
+// compareSnapshot compares the baseline with the scan or with the JSON output in currentName
+func compareSnapshot(baseline EntropyStructs, baselineName string, current EntropyStructs, currentName string, format string, output string) {
+	c := CompareSnapshots(baseline, current)
+	c.Baseline = baselineName
+	c.Current = currentName
+	c.PrintSummary()
+
+	output = output + "_changes"
+	if format != "csv" {
+		if err := c.CreateJSONFile(output); err != nil {
+			log.Printf("[W] Unable to save the changes: %v", err)
+		}
+	}
+	if format != "json" {
+		if err := c.CreatCSVFile(output); err != nil {
+			log.Printf("[W] Unable to save the changes: %v", err)
+		}
+	}
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Each file is read once, the data is copied through a multi-writer that calculates the hashes,
+// the entropy of the file, the entropy of the chunks and keeps the first 512 bytes for the MIME type
+// Only the sections of PE and ELF files are read a second time
+// The files are evaluated by a pool of workers and the results keep the order of the file list
+
+const mimeSniffSize = 512 // http.DetectContentType only uses the first 512 bytes
+
+// copyBuffers are reused by the workers so a large tree does not allocate a buffer for every file
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, 1024*1024)
+	return &buffer
+}}
+
+func entropyFromCounts(counts *[256]int, total int) float64 {
+	var entropy float64
+	dataLen := float64(total)
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		probability := float64(count) / dataLen
+		entropy -= probability * math.Log2(probability)
+	}
+	return entropy
+}
+
+// entropyRating - Low Entropy <= 5.0, High Entropy > 6.5
+func entropyRating(entropy float64) string {
+	if entropy <= 5.0 {
+		return "Low"
+	} else if entropy > 6.5 {
+		return "High"
+	}
+	return "Medium"
+}
+
+// byteCounter counts every byte of the file for the entropy of the whole file
+type byteCounter struct {
+	counts [256]int
+	total  int
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		b.counts[c]++
+	}
+	b.total += len(p)
+	return len(p), nil
+}
+
+// chunkCounter calculates the entropy of every chunk as the data is written, a chunk can be split across writes
+type chunkCounter struct {
+	size   int
+	counts [256]int
+	n      int
+	e      *EntropyFile
+}
+
+func (c *chunkCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.counts[b]++
+		c.n++
+		if c.n == c.size {
+			c.flush()
+		}
+	}
+	return len(p), nil
+}
+
+// flush rates the chunk, it is also called for the last chunk that is smaller than the chunk size
+func (c *chunkCounter) flush() {
+	if c.n == 0 {
+		return
+	}
+	entropy := entropyFromCounts(&c.counts, c.n)
+	c.e.ChunkEntropy = append(c.e.ChunkEntropy, roundEntropy(entropy))
+	switch entropyRating(entropy) {
+	case "Low":
+		c.e.LowEntropyChunks++
+	case "High":
+		c.e.HighEntropyChunks++
+	default:
+		c.e.MediumEntropyChunks++
+	}
+	c.e.TotalChunks++
+	c.counts = [256]int{}
+	c.n = 0
+}
+
+// headWriter keeps the first bytes of the file
+type headWriter struct {
+	head []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if left := mimeSniffSize - len(h.head); left > 0 {
+		if len(p) < left {
+			left = len(p)
+		}
+		h.head = append(h.head, p[:left]...)
+	}
+	return len(p), nil
+}
+
+// EvaluateFile reads the file once and fills in the hashes, MIME type and entropy
+// The chunks are only evaluated when the file is smaller than maxChunkFileSize
+// The rules are matched when they are not nil and the file is not larger than their MaxFileSize
+func EvaluateFile(f string, chunkSize int, maxChunkFileSize int, rules *RuleSet) EntropyFile {
+	var eFile EntropyFile
+	eFile.AddFileInformation(f)
+
+	file, err := os.Open(f)
+	if err != nil {
+		eFile.MIMEType = "Access is Denied"
+		eFile.EntropyRating = "None"
+		return eFile
+	}
+	defer file.Close()
+
+	md5Hash, sha1Hash, sha256Hash := md5.New(), sha1.New(), sha256.New()
+	counter := &byteCounter{}
+	head := &headWriter{}
+	writers := []io.Writer{md5Hash, sha1Hash, sha256Hash, counter, head}
+
+	var chunks *chunkCounter
+	if eFile.FileSize < int64(maxChunkFileSize) && chunkSize > 0 {
+		eFile.ChunksEvaluated = true
+		eFile.ChunkSize = chunkSize
+		chunks = &chunkCounter{size: chunkSize, e: &eFile}
+		writers = append(writers, chunks)
+	}
+
+	// The rules need the whole file, it is kept in memory while it is read
+	var content *bytes.Buffer
+	if rules != nil && eFile.FileSize <= int64(rules.MaxFileSize) {
+		content = bytes.NewBuffer(make([]byte, 0, eFile.FileSize))
+		writers = append(writers, content)
+	}
+
+	buffer := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(io.MultiWriter(writers...), file, *buffer)
+	copyBuffers.Put(buffer)
+	if err != nil {
+		// The hashes of a file that could not be read completely would not match the file
+		log.Printf("[W] Unable to read the file %s: %v", f, err)
+		eFile = EntropyFile{Name: eFile.Name, FilePath: eFile.FilePath, FileSize: eFile.FileSize, Permissions: eFile.Permissions, LastModified: eFile.LastModified}
+		eFile.MIMEType = "Access is Denied"
+		eFile.EntropyRating = "None"
+		return eFile
+	}
+	if chunks != nil {
+		chunks.flush()
+	}
+
+	eFile.MD5 = hashHex(md5Hash)
+	eFile.SHA1 = hashHex(sha1Hash)
+	eFile.SHA256 = hashHex(sha256Hash)
+	if len(head.head) > 0 {
+		eFile.MIMEType = http.DetectContentType(head.head)
+	}
+	eFile.Entropy = entropyFromCounts(&counter.counts, counter.total)
+	eFile.EntropyRating = entropyRating(eFile.Entropy)
+
+	// The sections of a PE or ELF file are read again from the open file
+	eFile.Binary = ProfileBinary(file, head.head, int64(counter.total))
+
+	if content != nil {
+		eFile.Rules = rules.Match(content.Bytes(), int64(counter.total))
+	}
+	return eFile
+}
+
+func hashHex(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// EvaluateFiles evaluates the file list with the number of workers, the results are in the order of the file list
+func (e *EntropyStructs) EvaluateFiles(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	e.EntropyFiles = make([]EntropyFile, len(e.FileList))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				Debug(fmt.Sprintf("\nEvaluating the file: %s - %s\n", e.FileList[i], calcTime()), e.Debug)
+				e.EntropyFiles[i] = EvaluateFile(e.FileList[i], e.ChunkSize, e.MaxFileSize, e.Rules)
+			}
+		}()
+	}
+	for i := range e.FileList {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
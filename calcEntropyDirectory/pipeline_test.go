@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Run with: go test -bench . -benchmem
+// Set CALCENTROPY_BENCH_DIR to a directory to measure the throughput on a real tree, e.g. a multi-GB source checkout or a disk image mount
+
+// benchmarkTree creates text, random and zero filled files so the chunks have low, medium and high entropy
+func benchmarkTree(b *testing.B) *EntropyStructs {
+	dir := b.TempDir()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 24; i++ {
+		data := make([]byte, 1024*1024)
+		switch i % 3 {
+		case 0:
+			r.Read(data)
+		case 1:
+			for j := range data {
+				data[j] = "the quick brown fox jumps over the lazy dog\n"[j%44]
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, "file"+string(rune('a'+i))), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return benchmarkStruct(b, dir)
+}
+
+func benchmarkStruct(b *testing.B, dir string) *EntropyStructs {
+	e := &EntropyStructs{BaseDir: dir, ChunkSize: 256, MaxDepth: -1, MaxFileSize: 10 * 1024 * 1024}
+	if err := e.GatherFileList(); err != nil {
+		b.Fatal(err)
+	}
+	var size int64
+	for _, f := range e.FileList {
+		if info, err := os.Stat(f); err == nil {
+			size += info.Size()
+		}
+	}
+	b.SetBytes(size)
+	return e
+}
+
+// evaluateSequential is the evaluation from before the pipeline, every file is read five times one file at a time
+func evaluateSequential(e *EntropyStructs) {
+	e.EntropyFiles = nil
+	for _, f := range e.FileList {
+		var eFile EntropyFile
+		eFile.AddFileInformation(f)
+		eFile.CalculateHashes(f)
+		eFile.IdentifyMIMEType(f)
+		file, err := os.Open(f)
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+		eFile.CalculateEntropy(data, "file")
+		if eFile.FileSize < int64(e.MaxFileSize) {
+			for i := 0; i < len(data); i += e.ChunkSize {
+				end := min(i+e.ChunkSize, len(data))
+				eFile.CalculateEntropy(data[i:end], "chunk")
+			}
+		}
+		e.EntropyFiles = append(e.EntropyFiles, eFile)
+	}
+}
+
+func BenchmarkSequential(b *testing.B) {
+	e := benchmarkTree(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		evaluateSequential(e)
+	}
+}
+
+func BenchmarkPipelineOneWorker(b *testing.B) {
+	e := benchmarkTree(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFiles(1)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	e := benchmarkTree(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFiles(runtime.NumCPU())
+	}
+}
+
+// BenchmarkPipelineTree evaluates every file in CALCENTROPY_BENCH_DIR, the MB/s column is the throughput
+func BenchmarkPipelineTree(b *testing.B) {
+	dir := os.Getenv("CALCENTROPY_BENCH_DIR")
+	if dir == "" {
+		b.Skip("CALCENTROPY_BENCH_DIR is not set")
+	}
+	e := benchmarkStruct(b, dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.EvaluateFiles(runtime.NumCPU())
+	}
+}
@@ -14,5 +14,5 @@ go env -w GO111MODULE='auto'
 # The dependencies do require golang version 1.24
 go get github.com/thepcn3rd/goAdvsCommonFunctions
 
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" main.go
-GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" main.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" .
+GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" .
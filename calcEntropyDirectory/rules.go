@@ -0,0 +1,1346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A subset of the YARA rule syntax is matched against the files while they are evaluated, so a second tool is not needed
+//
+// rule Name : tag1 tag2 {
+//     meta:
+//         description = "..."
+//     strings:
+//         $text = "text" nocase wide ascii fullword
+//         $hex  = { 4D 5A ?? 00 [2-4] ( 90 | CC ) }
+//         $re   = /regex/is
+//     condition:
+//         $text and #hex > 2 and filesize < 2MB and entropy(0, filesize) > 7.0
+// }
+//
+// Conditions support and, or, not, parentheses, the comparisons == != < <= > >=, + - * \, $a, #a (count),
+// $a at offset, $a in (start..end), any/all/none/N of them or of ($a, $b*) with an optional in (start..end), filesize, entropy(offset, size)
+// (also math.entropy), uint8/uint16/uint32(offset), uint16be/uint32be(offset), true, false and the names of earlier rules
+// Not supported: modules other than math, private/global rules, @a[i], !a[i], for loops and xor/base64 modifiers
+
+const maxStringMatches = 10000 // Matches of a string after which the search stops, like the limit of YARA
+
+type Rule struct {
+	Name      string
+	Tags      []string
+	Meta      map[string]string
+	strings   []*ruleString
+	condition conditionNode
+}
+
+type RuleSet struct {
+	Rules       []*Rule
+	MaxFileSize int // Larger files are not matched, the file has to be kept in memory
+}
+
+type ruleString struct {
+	id       string
+	text     []byte
+	nocase   bool
+	wide     bool
+	ascii    bool
+	fullword bool
+	hex      []hexNode
+	hexAlts  int // Number of alternatives in the hex string
+	re       *regexp.Regexp
+}
+
+// LoadRules parses a rule file or every .yar and .yara file in a directory
+func LoadRules(path string, maxFileSize int) (*RuleSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if !entry.IsDir() && (ext == ".yar" || ext == ".yara") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	rs := &RuleSet{MaxFileSize: maxFileSize}
+	names := make(map[string]bool)
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		p := &ruleParser{src: src, names: names}
+		rules, err := p.parseRules()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", f, p.line(), err)
+		}
+		rs.Rules = append(rs.Rules, rules...)
+	}
+	if len(rs.Rules) == 0 {
+		return nil, errors.New("no rules found in " + path)
+	}
+	return rs, nil
+}
+
+// Match returns the names of the rules that match the data, the rules are evaluated in the order they were loaded
+func (rs *RuleSet) Match(data []byte, fileSize int64) []string {
+	ctx := &scanContext{data: data, fileSize: fileSize, rules: make(map[string]bool)}
+	var matched []string
+	for _, rule := range rs.Rules {
+		ctx.rule = rule
+		ctx.matches = make(map[string][]int)
+		result := rule.condition.truth(ctx)
+		ctx.rules[rule.Name] = result
+		if result {
+			matched = append(matched, rule.Name)
+		}
+	}
+	return matched
+}
+
+// scanContext keeps the matches of the strings of the rule that is evaluated, a string is only searched when the condition uses it
+type scanContext struct {
+	data     []byte
+	lower    []byte // Lower case copy of the data for nocase strings
+	latin1   []byte // Copy of the data for the regexes, see latin1
+	fileSize int64
+	rule     *Rule
+	matches  map[string][]int
+	rules    map[string]bool
+}
+
+func (ctx *scanContext) stringMatches(id string) []int {
+	if offsets, found := ctx.matches[id]; found {
+		return offsets
+	}
+	var offsets []int
+	for _, s := range ctx.rule.strings {
+		if s.id == id {
+			offsets = s.find(ctx)
+			break
+		}
+	}
+	ctx.matches[id] = offsets
+	return offsets
+}
+
+// Parser
+
+type ruleParser struct {
+	src   []byte
+	pos   int
+	names map[string]bool // Rules that were already parsed and can be used in a condition
+	rule  *Rule
+}
+
+func (p *ruleParser) line() int {
+	return bytes.Count(p.src[:min(p.pos, len(p.src))], []byte("\n")) + 1
+}
+
+func (p *ruleParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch {
+		case p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\r' || p.src[p.pos] == '\n':
+			p.pos++
+		case bytes.HasPrefix(p.src[p.pos:], []byte("//")):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case bytes.HasPrefix(p.src[p.pos:], []byte("/*")):
+			end := bytes.Index(p.src[p.pos+2:], []byte("*/"))
+			if end < 0 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 4
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *ruleParser) peekByte() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *ruleParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && (isIdentByte(p.src[p.pos], p.pos == start) || p.isModuleDot(start)) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+// isModuleDot reports if the dot is in a name like math.entropy and not the start of a range
+func (p *ruleParser) isModuleDot(start int) bool {
+	return p.pos > start && p.src[p.pos] == '.' && p.pos+1 < len(p.src) && isIdentByte(p.src[p.pos+1], true)
+}
+
+// stringID reads the name after $ or #, it can start with a digit
+func (p *ruleParser) stringID() string {
+	start := p.pos
+	for p.pos < len(p.src) && isIdentByte(p.src[p.pos], false) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *ruleParser) expect(c byte) error {
+	if p.peekByte() != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// peekSection reports if the next word is the section name followed by a colon, e.g. "strings:"
+func (p *ruleParser) peekSection(name string) bool {
+	p.skipSpace()
+	if !bytes.HasPrefix(p.src[p.pos:], []byte(name)) {
+		return false
+	}
+	rest := p.src[p.pos+len(name):]
+	rest = bytes.TrimLeft(rest, " \t")
+	return len(rest) > 0 && rest[0] == ':'
+}
+
+func (p *ruleParser) section(name string) {
+	p.pos += len(name)
+	p.skipSpace()
+	p.pos++ // :
+}
+
+func (p *ruleParser) parseRules() ([]*Rule, error) {
+	var rules []*Rule
+	for {
+		word := p.ident()
+		switch word {
+		case "":
+			if p.pos < len(p.src) {
+				return nil, fmt.Errorf("unexpected %q", p.src[p.pos])
+			}
+			return rules, nil
+		case "import":
+			// Only the math module is supported, its entropy function is built in
+			module, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			if module != "math" {
+				return nil, fmt.Errorf("the module %q is not supported", module)
+			}
+		case "rule":
+			rule, err := p.parseRule()
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("%q is not supported, expected rule or import", word)
+		}
+	}
+}
+
+func (p *ruleParser) parseRule() (*Rule, error) {
+	rule := &Rule{Name: p.ident(), Meta: make(map[string]string)}
+	if rule.Name == "" {
+		return nil, errors.New("the rule has no name")
+	}
+	if p.names[rule.Name] {
+		return nil, fmt.Errorf("the rule %s is defined twice", rule.Name)
+	}
+	p.rule = rule
+	if p.peekByte() == ':' {
+		p.pos++
+		for p.peekByte() != '{' && p.pos < len(p.src) {
+			tag := p.ident()
+			if tag == "" {
+				return nil, errors.New("invalid tag")
+			}
+			rule.Tags = append(rule.Tags, tag)
+		}
+	}
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	if p.peekSection("meta") {
+		p.section("meta")
+		for !p.peekSection("strings") && !p.peekSection("condition") {
+			key := p.ident()
+			if key == "" {
+				return nil, errors.New("invalid meta")
+			}
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+			var value string
+			var err error
+			if p.peekByte() == '"' {
+				value, err = p.quoted()
+			} else {
+				value = p.ident()
+				if value == "" {
+					value, err = p.number()
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			rule.Meta[key] = value
+		}
+	}
+
+	if p.peekSection("strings") {
+		p.section("strings")
+		for p.peekByte() == '$' {
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range rule.strings {
+				if other.id == s.id {
+					return nil, fmt.Errorf("the string $%s is defined twice", s.id)
+				}
+			}
+			rule.strings = append(rule.strings, s)
+		}
+	}
+
+	if !p.peekSection("condition") {
+		return nil, errors.New("the rule has no condition")
+	}
+	p.section("condition")
+	condition, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	rule.condition = condition
+	if err := p.expect('}'); err != nil {
+		return nil, err
+	}
+	p.names[rule.Name] = true
+	return rule, nil
+}
+
+func (p *ruleParser) quoted() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	var value []byte
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return string(value), nil
+		case '\n':
+			return "", errors.New("the string is not closed")
+		case '\\':
+			if p.pos >= len(p.src) {
+				return "", errors.New("the string is not closed")
+			}
+			escaped := p.src[p.pos]
+			p.pos++
+			switch escaped {
+			case 'n':
+				value = append(value, '\n')
+			case 't':
+				value = append(value, '\t')
+			case 'r':
+				value = append(value, '\r')
+			case 'x':
+				if p.pos+2 > len(p.src) {
+					return "", errors.New("invalid \\x escape")
+				}
+				b, err := strconv.ParseUint(string(p.src[p.pos:p.pos+2]), 16, 8)
+				if err != nil {
+					return "", errors.New("invalid \\x escape")
+				}
+				value = append(value, byte(b))
+				p.pos += 2
+			default:
+				value = append(value, escaped)
+			}
+		default:
+			value = append(value, c)
+		}
+	}
+	return "", errors.New("the string is not closed")
+}
+
+func (p *ruleParser) number() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.src) && p.src[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.src) && (isIdentByte(p.src[p.pos], false) || p.src[p.pos] == '.') {
+		// 1..5 is a range, not a number
+		if p.src[p.pos] == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '.' {
+			break
+		}
+		p.pos++
+	}
+	if start == p.pos {
+		return "", errors.New("expected a number")
+	}
+	return string(p.src[start:p.pos]), nil
+}
+
+func (p *ruleParser) parseString() (*ruleString, error) {
+	p.pos++ // $
+	s := &ruleString{id: p.stringID()}
+	if err := p.expect('='); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch p.peekByte() {
+	case '"':
+		var text string
+		text, err = p.quoted()
+		s.text = []byte(text)
+		if len(s.text) == 0 {
+			return nil, fmt.Errorf("the string $%s is empty", s.id)
+		}
+	case '{':
+		var tokens []hexToken
+		if tokens, err = p.parseHex(); err == nil {
+			s.hex, s.hexAlts = compileHex(tokens)
+		}
+	case '/':
+		s.re, err = p.parseRegex()
+	default:
+		return nil, fmt.Errorf("invalid value for $%s", s.id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("$%s: %v", s.id, err)
+	}
+
+	// The modifiers end at the next string or the condition
+	for p.peekByte() != '$' && !p.peekSection("condition") {
+		switch modifier := p.ident(); modifier {
+		case "nocase":
+			s.nocase = true
+		case "wide":
+			s.wide = true
+		case "ascii":
+			s.ascii = true
+		case "fullword":
+			s.fullword = true
+		default:
+			return nil, fmt.Errorf("the modifier %q of $%s is not supported", modifier, s.id)
+		}
+	}
+	if s.re != nil && s.nocase {
+		s.re = regexp.MustCompile("(?i)" + s.re.String())
+	}
+	return s, nil
+}
+
+func (p *ruleParser) parseRegex() (*regexp.Regexp, error) {
+	p.pos++ // /
+	var pattern []byte
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			return nil, errors.New("the regular expression is not closed")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		if c == '/' {
+			break
+		}
+		if c == '\\' && p.pos < len(p.src) && p.src[p.pos] == '/' {
+			c = '/'
+			p.pos++
+		}
+		// A byte of a non-ASCII character in the rule is matched as a byte, like the data in latin1
+		if c >= utf8.RuneSelf {
+			pattern = append(pattern, fmt.Sprintf("\\x%02x", c)...)
+			continue
+		}
+		pattern = append(pattern, c)
+	}
+	flags := ""
+	for p.pos < len(p.src) && (p.src[p.pos] == 'i' || p.src[p.pos] == 's') {
+		flags += string(p.src[p.pos])
+		p.pos++
+	}
+	if flags != "" {
+		pattern = append([]byte("(?"+flags+")"), pattern...)
+	}
+	return regexp.Compile(string(pattern))
+}
+
+// latin1 returns the data with every byte above 0x7F as the rune of the same value, Go regexps read UTF-8 and YARA regexps
+// match bytes, so \x90 and . in a regex match one byte of the data
+func latin1(data []byte) []byte {
+	high := 0
+	for _, c := range data {
+		if c >= utf8.RuneSelf {
+			high++
+		}
+	}
+	if high == 0 {
+		return data
+	}
+	encoded := make([]byte, 0, len(data)+high)
+	for _, c := range data {
+		encoded = utf8.AppendRune(encoded, rune(c))
+	}
+	return encoded
+}
+
+// latin1Offsets maps the increasing offsets of matches in the latin1 copy back to the offsets in the data
+func latin1Offsets(data []byte, offsets []int) []int {
+	encoded, i := 0, 0
+	for n, offset := range offsets {
+		for encoded < offset {
+			encoded += utf8.RuneLen(rune(data[i]))
+			i++
+		}
+		offsets[n] = i
+	}
+	return offsets
+}
+
+// Hex strings
+
+type hexToken struct {
+	value    byte
+	mask     byte // 0xFF for a byte, 0x0F or 0xF0 for a nibble wildcard, 0 for ??
+	jump     bool
+	min, max int // Jump [min-max], max -1 is unbounded
+	alts     [][]hexToken
+}
+
+// hexNode is a token of a hex string in a graph, next is the node that follows it and -1 the end of the string
+// An alternative is a node with the first node of each alternative, the last node of every alternative continues
+// with the node after the group, so the tokens are never copied while the data is matched
+type hexNode struct {
+	value    byte
+	mask     byte
+	jump     bool
+	min, max int
+	alts     []int
+	slot     int // Number of the alternative, its results are in hexMatcher.alts
+	next     int
+}
+
+// compileHex returns the nodes of the tokens and the number of alternatives
+// The tokens are added from the end, so the last node is the start of the string
+func compileHex(tokens []hexToken) ([]hexNode, int) {
+	var nodes []hexNode
+	slots := 0
+	compileHexTokens(tokens, -1, &nodes, &slots)
+	return nodes, slots
+}
+
+func compileHexTokens(tokens []hexToken, next int, nodes *[]hexNode, slots *int) int {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		token := tokens[i]
+		node := hexNode{value: token.value, mask: token.mask, jump: token.jump, min: token.min, max: token.max, next: next}
+		if token.alts != nil {
+			node.slot = *slots
+			*slots++
+		}
+		for _, alt := range token.alts {
+			node.alts = append(node.alts, compileHexTokens(alt, next, nodes, slots))
+		}
+		*nodes = append(*nodes, node)
+		next = len(*nodes) - 1
+	}
+	return next
+}
+
+// hexMatcher matches the nodes of a hex string at every start in the data, the starts are searched in increasing order
+// The result of an alternative at a position is kept, so a string with many alternatives does not try every combination
+// again, and a jump keeps the first position where the rest of the string matches, so the positions after a jump are
+// checked once instead of once for every start
+type hexMatcher struct {
+	nodes []hexNode
+	data  []byte
+	alts  []altMemo  // altWindow results for each alternative, by position modulo altWindow
+	jumps []jumpMemo // One for each node
+}
+
+const altWindow = 4096 // Positions of an alternative that are kept, an older result at the same index is replaced
+
+// altMemo is the result of an alternative at a position, pos is the position + 1 so the zero value is empty
+type altMemo struct {
+	pos    int
+	result bool
+}
+
+// jumpMemo keeps the first position at or after from where the node after the jump matches, -1 when it matches nowhere
+type jumpMemo struct {
+	searched bool
+	from     int
+	next     int
+}
+
+func newHexMatcher(nodes []hexNode, slots int, data []byte) *hexMatcher {
+	return &hexMatcher{nodes: nodes, data: data, alts: make([]altMemo, slots*altWindow), jumps: make([]jumpMemo, len(nodes))}
+}
+
+// match reports if the string from the node matches the data at the position
+func (m *hexMatcher) match(n int, pos int) bool {
+	for n >= 0 {
+		node := &m.nodes[n]
+		switch {
+		case node.jump:
+			from, to := pos+node.min, len(m.data)
+			if node.max >= 0 {
+				to = min(pos+node.max, len(m.data))
+			}
+			if from > to {
+				return false
+			}
+			next := m.first(n, from)
+			return next >= 0 && next <= to
+		case node.alts != nil:
+			memo := &m.alts[node.slot*altWindow+pos%altWindow]
+			if memo.pos == pos+1 {
+				return memo.result
+			}
+			result := false
+			for _, alt := range node.alts {
+				if m.match(alt, pos) {
+					result = true
+					break
+				}
+			}
+			memo.pos, memo.result = pos+1, result
+			return result
+		default:
+			if pos >= len(m.data) || m.data[pos]&node.mask != node.value {
+				return false
+			}
+			pos++
+			n = node.next
+		}
+	}
+	return true
+}
+
+func (m *hexMatcher) first(n int, from int) int {
+	memo := &m.jumps[n]
+	if memo.searched && memo.from <= from && (memo.next < 0 || memo.next >= from) {
+		return memo.next
+	}
+	memo.searched, memo.from, memo.next = true, from, -1
+	for k := from; k <= len(m.data); k++ {
+		if m.match(m.nodes[n].next, k) {
+			memo.next = k
+			break
+		}
+	}
+	return memo.next
+}
+
+func (p *ruleParser) parseHex() ([]hexToken, error) {
+	p.pos++ // {
+	tokens, end, err := parseHexTokens(p.src, p.pos, '}')
+	p.pos = end
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || tokens[0].jump || tokens[len(tokens)-1].jump {
+		return nil, errors.New("a hex string can not be empty or start or end with a jump")
+	}
+	return tokens, nil
+}
+
+// parseHexTokens parses until the closing byte, an alternative ends with | or )
+func parseHexTokens(src []byte, pos int, closing byte) ([]hexToken, int, error) {
+	var tokens []hexToken
+	for pos < len(src) {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+		case c == closing || (closing == ')' && c == '|'):
+			return tokens, pos + 1, nil
+		case c == '[':
+			end := bytes.IndexByte(src[pos:], ']')
+			if end < 0 {
+				return nil, pos, errors.New("the jump is not closed")
+			}
+			jump := hexToken{jump: true}
+			from, to, isRange := strings.Cut(strings.TrimSpace(string(src[pos+1:pos+end])), "-")
+			var err error
+			if jump.min, err = strconv.Atoi(strings.TrimSpace(from)); err != nil && from != "" {
+				return nil, pos, errors.New("invalid jump")
+			}
+			jump.max = jump.min
+			if isRange {
+				jump.max = -1
+				if to = strings.TrimSpace(to); to != "" {
+					if jump.max, err = strconv.Atoi(to); err != nil || jump.max < jump.min {
+						return nil, pos, errors.New("invalid jump")
+					}
+				}
+			}
+			tokens = append(tokens, jump)
+			pos += end + 1
+		case c == '(':
+			alt := hexToken{mask: 0xFF}
+			pos++
+			for {
+				var alternative []hexToken
+				var err error
+				alternative, pos, err = parseHexTokens(src, pos, ')')
+				if err != nil {
+					return nil, pos, err
+				}
+				alt.alts = append(alt.alts, alternative)
+				if src[pos-1] == ')' {
+					break
+				}
+			}
+			tokens = append(tokens, alt)
+		default:
+			if pos+2 > len(src) {
+				return nil, pos, errors.New("the hex string is not closed")
+			}
+			token := hexToken{}
+			for i, n := range src[pos : pos+2] {
+				shift := uint(4 * (1 - i))
+				if n == '?' {
+					continue
+				}
+				v, err := strconv.ParseUint(string(n), 16, 8)
+				if err != nil {
+					return nil, pos, fmt.Errorf("invalid hex byte %q", src[pos:pos+2])
+				}
+				token.value |= byte(v) << shift
+				token.mask |= 0x0F << shift
+			}
+			tokens = append(tokens, token)
+			pos += 2
+		}
+	}
+	return nil, pos, errors.New("the hex string is not closed")
+}
+
+// Searching
+
+func (s *ruleString) find(ctx *scanContext) []int {
+	var offsets []int
+	switch {
+	case s.hex != nil:
+		m := newHexMatcher(s.hex, s.hexAlts, ctx.data)
+		start := len(s.hex) - 1
+		first := s.hex[start]
+		for i := 0; i < len(ctx.data) && len(offsets) < maxStringMatches; i++ {
+			// Skip to the next possible start when the first byte is known
+			if first.mask == 0xFF && first.alts == nil && !first.jump {
+				next := bytes.IndexByte(ctx.data[i:], first.value)
+				if next < 0 {
+					break
+				}
+				i += next
+			}
+			if m.match(start, i) {
+				offsets = append(offsets, i)
+			}
+		}
+	case s.re != nil:
+		if ctx.latin1 == nil {
+			ctx.latin1 = latin1(ctx.data)
+		}
+		for _, loc := range s.re.FindAllIndex(ctx.latin1, maxStringMatches) {
+			offsets = append(offsets, loc[0])
+		}
+		offsets = latin1Offsets(ctx.data, offsets)
+	default:
+		data := ctx.data
+		if s.nocase {
+			if ctx.lower == nil {
+				ctx.lower = asciiLower(ctx.data)
+			}
+			data = ctx.lower
+		}
+		for _, pattern := range s.patterns() {
+			for i := 0; len(offsets) < maxStringMatches; i++ {
+				next := bytes.Index(data[i:], pattern)
+				if next < 0 {
+					break
+				}
+				i += next
+				if !s.fullword || isFullword(data, i, len(pattern)) {
+					offsets = append(offsets, i)
+				}
+			}
+		}
+	}
+	return offsets
+}
+
+// patterns returns the ascii and the wide (UTF-16LE) form of a text string
+func (s *ruleString) patterns() [][]byte {
+	text := s.text
+	if s.nocase {
+		text = asciiLower(text)
+	}
+	var patterns [][]byte
+	if s.ascii || !s.wide {
+		patterns = append(patterns, text)
+	}
+	if s.wide {
+		wide := make([]byte, 0, len(text)*2)
+		for _, c := range text {
+			wide = append(wide, c, 0)
+		}
+		patterns = append(patterns, wide)
+	}
+	return patterns
+}
+
+// asciiLower only changes A-Z, bytes.ToLower would change the length of binary data that is not UTF-8
+func asciiLower(data []byte) []byte {
+	lower := make([]byte, len(data))
+	for i, c := range data {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
+
+func isFullword(data []byte, start int, length int) bool {
+	alnum := func(c byte) bool { return isIdentByte(c, false) }
+	if start > 0 && alnum(data[start-1]) {
+		return false
+	}
+	end := start + length
+	return end >= len(data) || !alnum(data[end])
+}
+
+// Conditions
+
+type conditionNode interface {
+	num(ctx *scanContext) float64
+	truth(ctx *scanContext) bool
+}
+
+func boolNum(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type numNode struct{ value float64 }
+
+func (n numNode) num(*scanContext) float64          { return n.value }
+func (n numNode) truth(*scanContext) bool           { return n.value != 0 }
+func (n boolNode) num(*scanContext) float64         { return boolNum(bool(n)) }
+func (n boolNode) truth(*scanContext) bool          { return bool(n) }
+func (n fileSizeNode) num(ctx *scanContext) float64 { return float64(ctx.fileSize) }
+func (n fileSizeNode) truth(ctx *scanContext) bool  { return ctx.fileSize != 0 }
+
+type boolNode bool
+type fileSizeNode struct{}
+
+// stringNode is $a, #a, $a at offset and $a in (start..end)
+type stringNode struct {
+	id       string
+	count    bool
+	at       conditionNode
+	from, to conditionNode
+}
+
+func (n stringNode) num(ctx *scanContext) float64 {
+	if n.count {
+		return float64(len(ctx.stringMatches(n.id)))
+	}
+	return boolNum(n.truth(ctx))
+}
+
+func (n stringNode) truth(ctx *scanContext) bool {
+	offsets := ctx.stringMatches(n.id)
+	if n.count {
+		return len(offsets) > 0
+	}
+	for _, offset := range offsets {
+		switch {
+		case n.at != nil:
+			if float64(offset) == n.at.num(ctx) {
+				return true
+			}
+		case n.from != nil:
+			if float64(offset) >= n.from.num(ctx) && float64(offset) <= n.to.num(ctx) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// ofNode is any, all, none or N of a set of strings, optionally in (start..end)
+type ofNode struct {
+	quantifier string // any, all, none or empty for count
+	count      conditionNode
+	ids        []string
+	from, to   conditionNode
+}
+
+func (n ofNode) truth(ctx *scanContext) bool {
+	found := 0
+	for _, id := range n.ids {
+		if (stringNode{id: id, from: n.from, to: n.to}).truth(ctx) {
+			found++
+		}
+	}
+	switch n.quantifier {
+	case "any":
+		return found > 0
+	case "all":
+		return found == len(n.ids)
+	case "none":
+		return found == 0
+	}
+	return float64(found) >= n.count.num(ctx)
+}
+
+func (n ofNode) num(ctx *scanContext) float64 { return boolNum(n.truth(ctx)) }
+
+type ruleNode struct{ name string }
+
+func (n ruleNode) truth(ctx *scanContext) bool  { return ctx.rules[n.name] }
+func (n ruleNode) num(ctx *scanContext) float64 { return boolNum(n.truth(ctx)) }
+
+type notNode struct{ node conditionNode }
+
+func (n notNode) truth(ctx *scanContext) bool  { return !n.node.truth(ctx) }
+func (n notNode) num(ctx *scanContext) float64 { return boolNum(n.truth(ctx)) }
+
+type binaryNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n binaryNode) truth(ctx *scanContext) bool {
+	switch n.op {
+	case "and":
+		return n.left.truth(ctx) && n.right.truth(ctx)
+	case "or":
+		return n.left.truth(ctx) || n.right.truth(ctx)
+	case "==":
+		return n.left.num(ctx) == n.right.num(ctx)
+	case "!=":
+		return n.left.num(ctx) != n.right.num(ctx)
+	case "<":
+		return n.left.num(ctx) < n.right.num(ctx)
+	case "<=":
+		return n.left.num(ctx) <= n.right.num(ctx)
+	case ">":
+		return n.left.num(ctx) > n.right.num(ctx)
+	case ">=":
+		return n.left.num(ctx) >= n.right.num(ctx)
+	}
+	value := n.num(ctx)
+	return value != 0 && !math.IsNaN(value)
+}
+
+func (n binaryNode) num(ctx *scanContext) float64 {
+	switch n.op {
+	case "+":
+		return n.left.num(ctx) + n.right.num(ctx)
+	case "-":
+		return n.left.num(ctx) - n.right.num(ctx)
+	case "*":
+		return n.left.num(ctx) * n.right.num(ctx)
+	case "\\":
+		return math.Trunc(n.left.num(ctx) / n.right.num(ctx))
+	}
+	return boolNum(n.truth(ctx))
+}
+
+// funcNode is entropy(offset, size) and the integer functions, an offset outside of the data is NaN so every comparison is false
+type funcNode struct {
+	name string
+	args []conditionNode
+}
+
+func (n funcNode) truth(ctx *scanContext) bool {
+	value := n.num(ctx)
+	return value != 0 && !math.IsNaN(value)
+}
+
+func (n funcNode) num(ctx *scanContext) float64 {
+	offset := n.args[0].num(ctx)
+	if math.IsNaN(offset) || offset < 0 || offset >= float64(len(ctx.data)) {
+		return math.NaN()
+	}
+	start := int(offset)
+	data := ctx.data[start:]
+	switch n.name {
+	case "entropy":
+		size := n.args[1].num(ctx)
+		if math.IsNaN(size) || size <= 0 {
+			return math.NaN()
+		}
+		// A size larger than an int overflows in the conversion, the size is limited to the data first
+		if size > float64(len(data)) {
+			size = float64(len(data))
+		}
+		data = data[:int(size)]
+		var counts [256]int
+		for _, c := range data {
+			counts[c]++
+		}
+		return entropyFromCounts(&counts, len(data))
+	case "uint8":
+		return float64(data[0])
+	}
+	width := map[string]int{"uint16": 2, "uint32": 4, "uint16be": 2, "uint32be": 4}[n.name]
+	if len(data) < width {
+		return math.NaN()
+	}
+	switch n.name {
+	case "uint16":
+		return float64(binary.LittleEndian.Uint16(data))
+	case "uint32":
+		return float64(binary.LittleEndian.Uint32(data))
+	case "uint16be":
+		return float64(binary.BigEndian.Uint16(data))
+	}
+	return float64(binary.BigEndian.Uint32(data))
+}
+
+var functionArgs = map[string]int{"entropy": 2, "math.entropy": 2, "uint8": 1, "uint16": 1, "uint32": 1, "uint16be": 1, "uint32be": 1}
+
+// Condition parser, lowest precedence first: or, and, not, comparison, + -, * \
+
+func (p *ruleParser) parseExpression() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("or") {
+		p.ident()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("and") {
+		p.ident()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseNot() (conditionNode, error) {
+	if p.peekWord("not") {
+		p.ident()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (conditionNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if bytes.HasPrefix(p.src[p.pos:], []byte(op)) {
+			p.pos += len(op)
+			right, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			return binaryNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseSum() (conditionNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peekByte(); c == '+' || c == '-'; c = p.peekByte() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: string(c), left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseProduct() (conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for c := p.peekByte(); c == '*' || c == '\\'; c = p.peekByte() {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: string(c), left: left, right: right}
+	}
+	return left, nil
+}
+
+// peekWord reports if the next identifier is the word
+func (p *ruleParser) peekWord(word string) bool {
+	start := p.pos
+	next := p.ident()
+	p.pos = start
+	return next == word
+}
+
+func (p *ruleParser) parsePrimary() (conditionNode, error) {
+	c := p.peekByte()
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(')')
+	case c == '$' || c == '#':
+		p.pos++
+		id := p.stringID()
+		if !p.hasString(id) {
+			return nil, fmt.Errorf("the string %c%s is not defined", c, id)
+		}
+		node := stringNode{id: id, count: c == '#'}
+		if c == '#' {
+			return node, nil
+		}
+		if p.peekWord("at") {
+			p.ident()
+			at, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			node.at = at
+		} else if p.peekWord("in") {
+			p.ident()
+			from, to, err := p.parseRange()
+			if err != nil {
+				return nil, err
+			}
+			node.from, node.to = from, to
+		}
+		return node, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		n, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekWord("of") {
+			p.ident()
+			return p.parseOf("", n)
+		}
+		return n, nil
+	}
+
+	word := p.ident()
+	switch word {
+	case "":
+		return nil, errors.New("invalid condition")
+	case "true", "false":
+		return boolNode(word == "true"), nil
+	case "filesize":
+		return fileSizeNode{}, nil
+	case "any", "all", "none":
+		if !p.peekWord("of") {
+			return nil, fmt.Errorf("expected of after %s", word)
+		}
+		p.ident()
+		return p.parseOf(word, nil)
+	}
+	if args, found := functionArgs[word]; found {
+		node := funcNode{name: strings.TrimPrefix(word, "math.")}
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		for i := 0; i < args; i++ {
+			if i > 0 {
+				if err := p.expect(','); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+		}
+		return node, p.expect(')')
+	}
+	if p.names[word] {
+		return ruleNode{name: word}, nil
+	}
+	return nil, fmt.Errorf("%q is not supported in a condition", word)
+}
+
+func (p *ruleParser) hasString(id string) bool {
+	for _, s := range p.rule.strings {
+		if s.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNumber reads decimal, hex (0x) and float numbers with the KB and MB suffixes
+func (p *ruleParser) parseNumber() (conditionNode, error) {
+	text, err := p.number()
+	if err != nil {
+		return nil, err
+	}
+	multiplier := 1.0
+	if strings.HasSuffix(text, "KB") {
+		multiplier, text = 1024, strings.TrimSuffix(text, "KB")
+	} else if strings.HasSuffix(text, "MB") {
+		multiplier, text = 1024*1024, strings.TrimSuffix(text, "MB")
+	}
+	var value float64
+	if strings.HasPrefix(text, "0x") {
+		var i int64
+		i, err = strconv.ParseInt(text[2:], 16, 64)
+		value = float64(i)
+	} else {
+		value, err = strconv.ParseFloat(text, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", text)
+	}
+	return numNode{value: value * multiplier}, nil
+}
+
+func (p *ruleParser) parseRange() (conditionNode, conditionNode, error) {
+	if err := p.expect('('); err != nil {
+		return nil, nil, err
+	}
+	from, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpace()
+	if !bytes.HasPrefix(p.src[p.pos:], []byte("..")) {
+		return nil, nil, errors.New("expected .. in the range")
+	}
+	p.pos += 2
+	to, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	return from, to, p.expect(')')
+}
+
+// parseOf reads "them" or a list of strings, $a* is every string that starts with a
+func (p *ruleParser) parseOf(quantifier string, count conditionNode) (conditionNode, error) {
+	node := ofNode{quantifier: quantifier, count: count}
+	if p.peekWord("them") {
+		p.ident()
+		for _, s := range p.rule.strings {
+			node.ids = append(node.ids, s.id)
+		}
+	} else {
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		for {
+			if err := p.expect('$'); err != nil {
+				return nil, err
+			}
+			id := p.stringID()
+			wildcard := p.pos < len(p.src) && p.src[p.pos] == '*'
+			if wildcard {
+				p.pos++
+			}
+			found := false
+			for _, s := range p.rule.strings {
+				if s.id == id || (wildcard && strings.HasPrefix(s.id, id)) {
+					node.ids = append(node.ids, s.id)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("the string $%s is not defined", id)
+			}
+			if p.peekByte() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+	}
+	if len(node.ids) == 0 {
+		return nil, errors.New("the rule has no strings")
+	}
+	if p.peekWord("in") {
+		p.ident()
+		from, to, err := p.parseRange()
+		if err != nil {
+			return nil, err
+		}
+		node.from, node.to = from, to
+	}
+	return node, nil
+}
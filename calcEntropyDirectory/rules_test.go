@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestRules(t *testing.T, src string) *RuleSet {
+	f := filepath.Join(t.TempDir(), "test.yar")
+	if err := os.WriteFile(f, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := LoadRules(f, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("Could not load the rules: %v", err)
+	}
+	return rs
+}
+
+func matchTestRules(rs *RuleSet, data []byte) string {
+	return strings.Join(rs.Match(data, int64(len(data))), ",")
+}
+
+// TestRegexMatchesBytes checks that a regex matches the bytes of the data like YARA and not the UTF-8 runes
+func TestRegexMatchesBytes(t *testing.T) {
+	rs := loadTestRules(t, `
+rule RegexMZ { strings: $a = /MZ\x90\x00/ condition: $a at 0 }
+rule HexMZ { strings: $a = { 4D 5A 90 00 } condition: $a at 0 }
+rule RegexOffset { strings: $a = /PE\x00\x00/ condition: $a at 4 }
+rule RegexDot { strings: $a = /A.B/ condition: #a == 1 }
+rule RegexHighRange { strings: $a = /[\x80-\xff]{3}/ condition: $a at 0 }
+`)
+	for _, test := range []struct {
+		data     string
+		expected string
+	}{
+		{"MZ\x90\x00\x03\x00", "RegexMZ,HexMZ"},
+		{"\xff\xfe\x80\x81PE\x00\x00", "RegexOffset,RegexHighRange"},
+		{"\xe9\xe9\xe9A\xe9B", "RegexDot,RegexHighRange"},
+		{"xxA\xc3\xa9B", ""},
+	} {
+		if matched := matchTestRules(rs, []byte(test.data)); matched != test.expected {
+			t.Errorf("%q: matched %q, expected %q", test.data, matched, test.expected)
+		}
+	}
+}
+
+// TestEntropyLargeSize checks that a size larger than an int is limited to the data
+func TestEntropyLargeSize(t *testing.T) {
+	rs := loadTestRules(t, `rule Large { condition: entropy(0, 1e30) > 1 and entropy(1, 1e30) < 8 }`)
+	if matched := matchTestRules(rs, []byte("abcdefgh")); matched != "Large" {
+		t.Errorf("matched %q, expected Large", matched)
+	}
+}
+
+// TestHexJumpLinear checks that an unbounded jump does not search the rest of the data again for every start
+func TestHexJumpLinear(t *testing.T) {
+	rs := loadTestRules(t, `
+rule Unbounded { strings: $a = { 00 [-] 01 } condition: $a }
+rule Bounded { strings: $a = { 00 [0-1000000] 02 } condition: #a == 3 }
+rule Alternative { strings: $a = { 00 ( 03 | [2-] 01 ) } condition: $a }
+rule Groups { strings: $a = { 00 `+strings.Repeat("( 00 | 00 ) ", 12)+`01 } condition: $a }
+`)
+	data := make([]byte, 2*1024*1024)
+	start := time.Now()
+	if matched := matchTestRules(rs, data); matched != "" {
+		t.Errorf("zeros: matched %q, expected none", matched)
+	}
+	data[len(data)-1] = 2
+	data[3] = 1
+	if matched := matchTestRules(rs, data); matched != "Unbounded,Alternative" {
+		t.Errorf("matched %q, expected Unbounded,Alternative", matched)
+	}
+	// Every alternative of the groups matches, the 01 is after the 13 zeros
+	data[100] = 1
+	if matched := matchTestRules(rs, data); matched != "Unbounded,Alternative,Groups" {
+		t.Errorf("matched %q, expected Unbounded,Alternative,Groups", matched)
+	}
+	// The three zeros before the 02 are the starts
+	data = append(make([]byte, 3), 2)
+	if matched := matchTestRules(rs, data); matched != "Bounded" {
+		t.Errorf("matched %q, expected Bounded", matched)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the hex strings took %v", elapsed)
+	}
+}
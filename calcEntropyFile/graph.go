@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// The entropy of the chunks is drawn as a bar graph, the x axis is the offset in the file and the y axis the entropy (0 to 8)
+// A file with more chunks than maxGraphPoints is drawn with one bar for several chunks, the bar has the highest entropy
+// of its chunks so a small encrypted blob in a large file is still visible
+
+const (
+	maxGraphPoints = 1200
+	graphHeight    = 256 // 32 pixels per bit of entropy
+	graphMargin    = 40
+	previewSize    = 64 // Bytes of the chunk shown in the HTML page
+)
+
+var (
+	graphLow    = color.RGBA{0x2e, 0xa0, 0x43, 0xff}
+	graphMedium = color.RGBA{0xe3, 0xb3, 0x41, 0xff}
+	graphHigh   = color.RGBA{0xd7, 0x3a, 0x49, 0xff}
+	graphGrid   = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	graphAxis   = color.RGBA{0x33, 0x33, 0x33, 0xff}
+)
+
+// graphPoint is one bar of the graph, Chunk is the chunk with the highest entropy in the bar
+type graphPoint struct {
+	Start   int64
+	End     int64
+	Chunk   int
+	Entropy float64
+}
+
+func ratingColor(entropy float64) color.RGBA {
+	if entropy <= 5.0 {
+		return graphLow
+	} else if entropy > 6.5 {
+		return graphHigh
+	}
+	return graphMedium
+}
+
+func ratingName(entropy float64) string {
+	if entropy <= 5.0 {
+		return "Low"
+	} else if entropy > 6.5 {
+		return "High"
+	}
+	return "Medium"
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func graphPoints(entropies []float64, chunkSize int, dataLen int) []graphPoint {
+	perPoint := (len(entropies) + maxGraphPoints - 1) / maxGraphPoints
+	var points []graphPoint
+	for i := 0; i < len(entropies); i += perPoint {
+		end := min(i+perPoint, len(entropies))
+		point := graphPoint{Start: int64(i * chunkSize), End: int64(min(end*chunkSize, dataLen)), Chunk: i, Entropy: entropies[i]}
+		for j := i + 1; j < end; j++ {
+			if entropies[j] > point.Entropy {
+				point.Chunk, point.Entropy = j, entropies[j]
+			}
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// barWidth makes a graph of a small file wide enough to see
+func barWidth(points int) int {
+	return max(1, maxGraphPoints/max(points, 1))
+}
+
+func barHeight(entropy float64) int {
+	return int(entropy*graphHeight/8 + 0.5)
+}
+
+// SavePNG draws the graph without labels, the lines are the Low (5.0) and High (6.5) limits
+func SavePNG(f string, points []graphPoint) error {
+	bw := barWidth(len(points))
+	width := len(points)*bw + 2*graphMargin
+	height := graphHeight + 2*graphMargin
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	bottom := graphMargin + graphHeight
+	for _, limit := range []float64{5.0, 6.5} {
+		y := bottom - barHeight(limit)
+		for x := graphMargin; x < width-graphMargin; x += 2 {
+			img.Set(x, y, graphGrid)
+		}
+	}
+	for i, point := range points {
+		c := ratingColor(point.Entropy)
+		for x := graphMargin + i*bw; x < graphMargin+(i+1)*bw; x++ {
+			for y := bottom - barHeight(point.Entropy); y < bottom; y++ {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	for x := graphMargin; x < width-graphMargin; x++ {
+		img.Set(x, bottom, graphAxis)
+	}
+	for y := graphMargin; y <= bottom; y++ {
+		img.Set(graphMargin-1, y, graphAxis)
+	}
+
+	file, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return png.Encode(file, img)
+}
+
+// writeSVG writes the graph with the axis labels, every bar has a title with the offset and the entropy
+// The bars of the HTML page have the index of the point for the hover details
+func writeSVG(w io.Writer, points []graphPoint, name string, fileSize int, interactive bool) {
+	bw := barWidth(len(points))
+	width := len(points)*bw + 2*graphMargin
+	height := graphHeight + 2*graphMargin
+	bottom := graphMargin + graphHeight
+
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="monospace" font-size="11">`+"\n", width, height, width, height)
+	fmt.Fprintf(w, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+	fmt.Fprintf(w, `<text x="%d" y="%d" font-size="13">Entropy of %s</text>`+"\n", graphMargin, graphMargin-20, html.EscapeString(name))
+
+	for bits := 0; bits <= 8; bits += 2 {
+		y := bottom - barHeight(float64(bits))
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end">%d</text>`+"\n", graphMargin-6, y+4, bits)
+	}
+	for _, limit := range []float64{5.0, 6.5} {
+		y := bottom - barHeight(limit)
+		fmt.Fprintf(w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s" stroke-dasharray="4 2"/>`+"\n", graphMargin, y, width-graphMargin, y, hexColor(graphGrid))
+	}
+
+	for i, point := range points {
+		h := barHeight(point.Entropy)
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"`, graphMargin+i*bw, bottom-h, bw, max(h, 1), hexColor(ratingColor(point.Entropy)))
+		if interactive {
+			fmt.Fprintf(w, ` data-i="%d"/>`+"\n", i)
+		} else {
+			fmt.Fprintf(w, `><title>0x%x - 0x%x: %.4f (%s)</title></rect>`+"\n", point.Start, point.End, point.Entropy, ratingName(point.Entropy))
+		}
+	}
+
+	fmt.Fprintf(w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`+"\n", graphMargin, bottom, width-graphMargin, bottom, hexColor(graphAxis))
+	fmt.Fprintf(w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`+"\n", graphMargin, graphMargin, graphMargin, bottom, hexColor(graphAxis))
+	fmt.Fprintf(w, `<text x="%d" y="%d">0x0</text>`+"\n", graphMargin, bottom+16)
+	fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end">0x%x</text>`+"\n", width-graphMargin, bottom+16, fileSize)
+	fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="middle">offset</text>`+"\n", width/2, bottom+16)
+	fmt.Fprintln(w, `</svg>`)
+}
+
+func SaveSVG(f string, points []graphPoint, name string, fileSize int) error {
+	file, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writeSVG(file, points, name, fileSize, false)
+	return nil
+}
+
+// htmlPoint is the hover information of a bar, the preview is the start of the chunk with the highest entropy
+type htmlPoint struct {
+	Start   string  `json:"start"`
+	End     string  `json:"end"`
+	Chunk   int     `json:"chunk"`
+	Offset  string  `json:"offset"`
+	Entropy float64 `json:"entropy"`
+	Rating  string  `json:"rating"`
+	Hex     string  `json:"hex"`
+	ASCII   string  `json:"ascii"`
+}
+
+var htmlTemplate = template.Must(template.New("graph").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Entropy of {{.Name}}</title>
+<style>
+body { font-family: monospace; margin: 20px; }
+rect[data-i]:hover { opacity: 0.6; }
+#details { white-space: pre; border: 1px solid #ccc; padding: 8px; min-height: 8em; }
+</style>
+</head>
+<body>
+<div>{{.Name}} - {{.FileSize}} bytes - entropy {{printf "%.4f" .Entropy}} bits/byte - chunk size {{.ChunkSize}}</div>
+<div id="graph">{{.SVG}}</div>
+<div id="details">Move the mouse over a bar to see the offset and the bytes of the chunk</div>
+<script>
+const points = {{.Points}};
+document.querySelectorAll("rect[data-i]").forEach(function (bar) {
+  bar.addEventListener("mouseover", function () {
+    const p = points[bar.dataset.i];
+    let text = "Range:   " + p.start + " - " + p.end + "\n" +
+      "Chunk:   " + p.chunk + " at " + p.offset + "\n" +
+      "Entropy: " + p.entropy.toFixed(4) + " (" + p.rating + ")\n\n";
+    for (let i = 0; i < p.hex.length; i += 32) {
+      text += p.hex.substring(i, i + 32).replace(/(..)/g, "$1 ") + " | " + p.ascii.substring(i / 2, i / 2 + 16) + "\n";
+    }
+    document.getElementById("details").textContent = text;
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// SaveHTML writes a page without external files, the points are in the page for the hover details
+func SaveHTML(f string, points []graphPoint, data []byte, name string, chunkSize int, entropy float64) error {
+	var svg bytes.Buffer
+	writeSVG(&svg, points, name, len(data), true)
+
+	details := make([]htmlPoint, len(points))
+	for i, point := range points {
+		offset := point.Chunk * chunkSize
+		preview := data[offset:min(offset+previewSize, len(data))]
+		var ascii strings.Builder
+		for _, b := range preview {
+			if b >= 32 && b <= 126 {
+				ascii.WriteByte(b)
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		details[i] = htmlPoint{
+			Start:   fmt.Sprintf("0x%x", point.Start),
+			End:     fmt.Sprintf("0x%x", point.End),
+			Chunk:   point.Chunk,
+			Offset:  fmt.Sprintf("0x%x", offset),
+			Entropy: point.Entropy,
+			Rating:  ratingName(point.Entropy),
+			Hex:     hex.EncodeToString(preview),
+			ASCII:   ascii.String(),
+		}
+	}
+	pointsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return htmlTemplate.Execute(file, map[string]interface{}{
+		"Name":      name,
+		"FileSize":  len(data),
+		"Entropy":   entropy,
+		"ChunkSize": chunkSize,
+		"SVG":       template.HTML(svg.String()),
+		"Points":    template.JS(pointsJSON),
+	})
+}
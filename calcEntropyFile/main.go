@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 )
 
@@ -172,6 +173,9 @@ func main() {
 	filePtr := flag.String("f", "", "File to read and calculate entropy")
 	chunkSizePtr := flag.Int("s", 256, "Size of Chunk Evaluated")
 	flag.BoolVar(&chunkASCIIOutput, "d", false, "Disable Output of Chunk Information")
+	pngPtr := flag.String("png", "", "Save the entropy graph of the chunks to this PNG file")
+	svgPtr := flag.String("svg", "", "Save the entropy graph of the chunks to this SVG file")
+	htmlPtr := flag.String("html", "", "Save the entropy graph of the chunks to this HTML page with the offset and hex of each chunk")
 	flag.Parse()
 
 	addFileInformation(*filePtr)
@@ -207,6 +211,7 @@ func main() {
 	// Create a buffer to read 64 bytes at a time
 
 	totalChunks := 0
+	var chunkEntropies []float64
 	lowEntropyChunks := 0
 	mediumEntropyChunks := 0
 	highEntropyChunks := 0
@@ -215,6 +220,7 @@ func main() {
 		chunk := data[i:end]
 
 		entropyChunk := calculateEntropy(chunk)
+		chunkEntropies = append(chunkEntropies, entropyChunk)
 
 		// Low Entropy <= 5.0
 		if entropyChunk <= 5.0 {
@@ -271,4 +277,25 @@ func main() {
 	fmt.Printf("\n%sTotal Chunks:%s %d\n", colorGreen, colorReset, totalChunks)
 	fmt.Printf("%sChunks with Low:%s %d - %sMed:%s %d - %sHigh:%s %d %sEntropy%s\n\n", colorGreen, colorReset, lowEntropyChunks, colorYellow, colorReset, mediumEntropyChunks, colorRed, colorReset, highEntropyChunks, colorGreen, colorReset)
 
+	// Draw the entropy of the chunks
+	points := graphPoints(chunkEntropies, chunkSize, len(data))
+	name := filepath.Base(*filePtr)
+	graphs := []struct {
+		file string
+		save func(string) error
+	}{
+		{*pngPtr, func(f string) error { return SavePNG(f, points) }},
+		{*svgPtr, func(f string) error { return SaveSVG(f, points, name, len(data)) }},
+		{*htmlPtr, func(f string) error { return SaveHTML(f, points, data, name, chunkSize, entropy) }},
+	}
+	for _, graph := range graphs {
+		if len(graph.file) == 0 {
+			continue
+		}
+		if err := graph.save(graph.file); err != nil {
+			fmt.Println("Error saving the entropy graph:", err)
+			continue
+		}
+		fmt.Printf("%sEntropy graph saved to:%s %s\n", colorGreen, colorReset, graph.file)
+	}
 }
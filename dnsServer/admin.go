@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	cf "github.com/thepcn3rd/goAdvsCommonFunctions"
+)
+
+// Admin API, every request requires basic authentication
+// GET    /api/records               List the records from the configuration
+// POST   /api/records/<type>        Add a record, the body is the same JSON used in config.json (type is a, aaaa, cname, mx, srv or txt)
+// DELETE /api/records/<type>?name=  Delete every record of the type with the name
+// POST   /api/reload                Reload the configuration file
+// POST   /api/cache/flush           Remove every answer from the cache
+// GET    /api/stats                 Query, cache, upstream and record counters
+
+const defaultAdminAddress = "127.0.0.1:8053"
+
+type AdminConfig struct {
+	Enabled       bool   `json:"enabled"`
+	ListenAddress string `json:"listenAddress"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	UseTLS        bool   `json:"useTLS"`      // Serve the API with the certificate in tlsOptions
+	SaveChanges   bool   `json:"saveChanges"` // Write the records changed with the API to the configuration file
+}
+
+// RecordsList is the response to GET /api/records
+type RecordsList struct {
+	LocalZones   []string             `json:"localZones"`
+	ZoneFiles    []ZoneFilesStruct    `json:"zoneFiles"`
+	ARecords     []ARecordsStruct     `json:"aRecords"`
+	AAAARecords  []AAAARecordsStruct  `json:"aaaaRecords"`
+	CNAMERecords []CNAMERecordsStruct `json:"cnameRecords"`
+	MXRecords    []MXRecordsStruct    `json:"mxRecords"`
+	SRVRecords   []SRVRecordsStruct   `json:"srvRecords"`
+	TXTRecords   []TXTRecordsStruct   `json:"txtRecords"`
+}
+
+// ServerStats is the response to GET /api/stats
+type ServerStats struct {
+	Started    string           `json:"started"`
+	Loaded     string           `json:"loaded"`
+	Uptime     string           `json:"uptime"`
+	Queries    uint64           `json:"queries"`
+	Alerts     uint64           `json:"alerts"`
+	Records    int              `json:"records"`
+	Zones      int              `json:"zones"`
+	Blocklists int              `json:"blocklists"`
+	Cache      CacheStats       `json:"cache"`
+	Upstreams  []UpstreamStatus `json:"upstreams"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// authAdmin is the basic authentication from the sslReverseProxy, the API can not be used without a username and password
+func authAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		sha256InputPassword := cf.CalcSHA256Hash(password)
+		sha256StoredPassword := cf.CalcSHA256Hash(config.AdminOptions.Password)
+		if !ok || username != config.AdminOptions.Username || sha256InputPassword != sha256StoredPassword {
+			logMessage(fmt.Sprintf("Failed admin API login from %s", r.RemoteAddr), nil)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *DNSServer) handleRecords(w http.ResponseWriter, r *http.Request) {
+	recordType := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/records"), "/"))
+
+	switch {
+	case r.Method == http.MethodGet && recordType == "":
+		s.mutex.RLock()
+		c := s.recordConfig
+		list := RecordsList{
+			LocalZones:   c.LocalZones,
+			ZoneFiles:    c.ZoneFiles,
+			ARecords:     c.ARecords,
+			AAAARecords:  c.AAAARecords,
+			CNAMERecords: c.CNAMERecords,
+			MXRecords:    c.MXRecords,
+			SRVRecords:   c.SRVRecords,
+			TXTRecords:   c.TXTRecords,
+		}
+		s.mutex.RUnlock()
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == http.MethodPost && recordType != "":
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = s.updateRecords(func(c *Configuration) error {
+			return addRecord(c, recordType, body)
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logMessage(fmt.Sprintf("Admin API added %s record %s from %s", recordType, string(body), r.RemoteAddr), nil)
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "added"})
+	case r.Method == http.MethodDelete && recordType != "":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		err := s.updateRecords(func(c *Configuration) error {
+			return deleteRecord(c, recordType, name)
+		})
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		logMessage(fmt.Sprintf("Admin API deleted %s record %s from %s", recordType, name, r.RemoteAddr), nil)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// addRecord decodes the record from the body and appends it to the configuration
+func addRecord(c *Configuration, recordType string, body []byte) error {
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.DisallowUnknownFields()
+
+	switch recordType {
+	case "a":
+		var record ARecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if ip := net.ParseIP(record.IP); record.AName == "" || ip == nil || ip.To4() == nil {
+			return fmt.Errorf("aName and an IPv4 ip are required")
+		}
+		c.ARecords = append(c.ARecords, record)
+	case "aaaa":
+		var record AAAARecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if ip := net.ParseIP(record.IP); record.AAAAName == "" || ip == nil || ip.To4() != nil {
+			return fmt.Errorf("aaaaName and an IPv6 ip are required")
+		}
+		c.AAAARecords = append(c.AAAARecords, record)
+	case "cname":
+		var record CNAMERecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if record.CNAMEName == "" || record.Target == "" {
+			return fmt.Errorf("cnameName and target are required")
+		}
+		c.CNAMERecords = append(c.CNAMERecords, record)
+	case "mx":
+		var record MXRecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if record.MXName == "" || record.Exchange == "" {
+			return fmt.Errorf("mxName and exchange are required")
+		}
+		c.MXRecords = append(c.MXRecords, record)
+	case "srv":
+		var record SRVRecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if record.SRVName == "" || record.Target == "" {
+			return fmt.Errorf("srvName and target are required")
+		}
+		c.SRVRecords = append(c.SRVRecords, record)
+	case "txt":
+		var record TXTRecordsStruct
+		if err := decoder.Decode(&record); err != nil {
+			return err
+		}
+		if record.TXTName == "" {
+			return fmt.Errorf("txtName is required")
+		}
+		c.TXTRecords = append(c.TXTRecords, record)
+	default:
+		return fmt.Errorf("unknown record type %s", recordType)
+	}
+	return nil
+}
+
+// deleteRecord removes every record of the type with the name, names are compared the same way they are looked up
+func deleteRecord(c *Configuration, recordType string, name string) error {
+	name = localName(name)
+	deleted := 0
+
+	switch recordType {
+	case "a":
+		var kept []ARecordsStruct
+		for _, record := range c.ARecords {
+			if localName(record.AName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.ARecords = kept
+	case "aaaa":
+		var kept []AAAARecordsStruct
+		for _, record := range c.AAAARecords {
+			if localName(record.AAAAName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.AAAARecords = kept
+	case "cname":
+		var kept []CNAMERecordsStruct
+		for _, record := range c.CNAMERecords {
+			if localName(record.CNAMEName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.CNAMERecords = kept
+	case "mx":
+		var kept []MXRecordsStruct
+		for _, record := range c.MXRecords {
+			if localName(record.MXName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.MXRecords = kept
+	case "srv":
+		var kept []SRVRecordsStruct
+		for _, record := range c.SRVRecords {
+			if localName(record.SRVName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.SRVRecords = kept
+	case "txt":
+		var kept []TXTRecordsStruct
+		for _, record := range c.TXTRecords {
+			if localName(record.TXTName) == name {
+				deleted++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		c.TXTRecords = kept
+	default:
+		return fmt.Errorf("unknown record type %s", recordType)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("no %s record named %s", recordType, name)
+	}
+	return nil
+}
+
+func (s *DNSServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.Reload(); err != nil {
+		logMessage("Failed to reload the records, keeping the current records", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (s *DNSServer) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.cache.Flush()
+	logMessage(fmt.Sprintf("Admin API flushed the cache from %s", r.RemoteAddr), nil)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "flushed"})
+}
+
+func (s *DNSServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.mutex.RLock()
+	c := s.recordConfig
+	stats := ServerStats{
+		Started:    s.started.UTC().Format(time.RFC3339),
+		Loaded:     s.loaded.UTC().Format(time.RFC3339),
+		Uptime:     time.Since(s.started).Round(time.Second).String(),
+		Records:    len(c.ARecords) + len(c.AAAARecords) + len(c.CNAMERecords) + len(c.MXRecords) + len(c.SRVRecords) + len(c.TXTRecords),
+		Zones:      len(s.zones),
+		Blocklists: len(c.BlocklistOpts.Lists),
+	}
+	s.mutex.RUnlock()
+	stats.Queries = s.queries.Load()
+	stats.Alerts = s.alerts.Load()
+	stats.Cache = s.cache.Stats()
+	stats.Upstreams = s.upstreams.Status()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// startAdmin starts the admin API, a username and password are required
+func startAdmin(s *DNSServer, tlsConfig *tls.Config, errChan chan error) {
+	if config.AdminOptions.Username == "" || config.AdminOptions.Password == "" {
+		logMessage("WARNING: The admin API is not started, set a username and password in adminOptions", nil)
+		return
+	}
+	listenAddress := config.AdminOptions.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultAdminAddress
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/records", authAdmin(s.handleRecords))
+	mux.HandleFunc("/api/records/", authAdmin(s.handleRecords))
+	mux.HandleFunc("/api/reload", authAdmin(s.handleReload))
+	mux.HandleFunc("/api/cache/flush", authAdmin(s.handleFlush))
+	mux.HandleFunc("/api/stats", authAdmin(s.handleStats))
+	httpServer := &http.Server{
+		Addr:         listenAddress,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	logMessage(fmt.Sprintf("Starting admin API on %s", listenAddress), nil)
+	go func() {
+		if config.AdminOptions.UseTLS {
+			httpServer.TLSConfig = tlsConfig
+			errChan <- fmt.Errorf("admin API: %v", httpServer.ListenAndServeTLS("", ""))
+			return
+		}
+		errChan <- fmt.Errorf("admin API: %v", httpServer.ListenAndServe())
+	}()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://www.sans.org/white-papers/34152/ (Detecting DNS tunneling)
+// References: https://unit42.paloaltonetworks.com/dns-tunneling-how-dns-can-be-abused-by-malicious-actors/
+
+const (
+	defaultEntropyThreshold      = 3.5 // Bits per character, random base32 or hex labels are usually above 3.5
+	defaultMinEntropyLength      = 16  // Short labels do not have enough characters for the entropy to mean anything
+	defaultLongLabelLength       = 40
+	defaultLongNameLength        = 100
+	defaultUniqueSubdomains      = 100
+	defaultTXTNullQueries        = 50
+	defaultAnalyzerWindowMinutes = 10
+	defaultAlertScore            = 50 // The subdomain, TXT and NULL and generated domain checks reach it on their own
+	webhookQueueSize             = 256
+)
+
+type AnalyzerConfig struct {
+	Enabled          bool     `json:"enabled"`
+	EntropyThreshold float64  `json:"entropyThreshold"`
+	MinEntropyLength int      `json:"minEntropyLength"`
+	LongLabelLength  int      `json:"longLabelLength"`
+	LongNameLength   int      `json:"longNameLength"`
+	UniqueSubdomains int      `json:"uniqueSubdomains"` // Unique subdomains of a parent domain in a window
+	TXTNullQueries   int      `json:"txtNullQueries"`   // TXT and NULL queries from a client in a window
+	WindowMinutes    int      `json:"windowMinutes"`
+	AlertScore       int      `json:"alertScore"`
+	WebhookURL       string   `json:"webhookURL"`
+	IgnoreDomains    []string `json:"ignoreDomains"` // Domains that are never scored, e.g. CDNs and anti-virus lookups
+}
+
+// Alert is added to the query log entry and sent to the webhook
+type Alert struct {
+	Time     string   `json:"time"`
+	Server   string   `json:"server"`
+	ClientIP string   `json:"clientIP"`
+	QName    string   `json:"qname"`
+	QType    string   `json:"qtype"`
+	Parent   string   `json:"parent"`
+	Score    int      `json:"score"`
+	Reasons  []string `json:"reasons"`
+}
+
+// Analyzer scores each query and keeps the counters for the current window
+type Analyzer struct {
+	options     AnalyzerConfig
+	mutex       sync.Mutex
+	windowStart time.Time
+	subdomains  map[string]map[string]bool // Parent domain to the unique subdomains seen in the window
+	txtNull     map[string]int             // Client IP to the number of TXT and NULL queries in the window
+	alerted     map[string]bool            // Client and parent domains already sent to the webhook in the window
+	webhook     chan *Alert
+}
+
+func NewAnalyzer(options AnalyzerConfig) *Analyzer {
+	if options.EntropyThreshold <= 0 {
+		options.EntropyThreshold = defaultEntropyThreshold
+	}
+	if options.MinEntropyLength <= 0 {
+		options.MinEntropyLength = defaultMinEntropyLength
+	}
+	if options.LongLabelLength <= 0 {
+		options.LongLabelLength = defaultLongLabelLength
+	}
+	if options.LongNameLength <= 0 {
+		options.LongNameLength = defaultLongNameLength
+	}
+	if options.UniqueSubdomains <= 0 {
+		options.UniqueSubdomains = defaultUniqueSubdomains
+	}
+	if options.TXTNullQueries <= 0 {
+		options.TXTNullQueries = defaultTXTNullQueries
+	}
+	if options.WindowMinutes <= 0 {
+		options.WindowMinutes = defaultAnalyzerWindowMinutes
+	}
+	if options.AlertScore <= 0 {
+		options.AlertScore = defaultAlertScore
+	}
+	// A new slice, the options share the IgnoreDomains of the config
+	ignoreDomains := make([]string, 0, len(options.IgnoreDomains))
+	for _, domain := range options.IgnoreDomains {
+		ignoreDomains = append(ignoreDomains, localName(domain))
+	}
+	options.IgnoreDomains = ignoreDomains
+
+	a := &Analyzer{options: options}
+	a.resetWindow(time.Now())
+	if options.Enabled && options.WebhookURL != "" {
+		a.webhook = make(chan *Alert, webhookQueueSize)
+		go a.sendWebhooks()
+	}
+	return a
+}
+
+// calculateEntropy is the Shannon entropy function from calcEntropyFile, applied to a label instead of a file
+func calculateEntropy(data []byte) float64 {
+	// Initialize a map to store the frequency of each byte
+	frequency := make(map[byte]int)
+	for _, b := range data {
+		frequency[b]++
+	}
+
+	// Calculate the entropy
+	var entropy float64
+	dataLen := float64(len(data))
+	for _, count := range frequency {
+		probability := float64(count) / dataLen
+		entropy -= probability * math.Log2(probability)
+	}
+
+	return entropy
+}
+
+// parentDomain returns the last two labels of the name, without a public suffix list co.uk is treated like a domain
+func parentDomain(labels []string) string {
+	if len(labels) < 2 {
+		return strings.Join(labels, ".") + "."
+	}
+	return strings.Join(labels[len(labels)-2:], ".") + "."
+}
+
+// dgaLike returns true when the label looks generated instead of chosen by a person
+// Names chosen by people are pronounceable, generated names have long runs of consonants, mixed digits and few vowels
+func dgaLike(label string) bool {
+	if len(label) < 8 {
+		return false
+	}
+	var vowels, digits, run, longestRun int
+	for _, c := range label {
+		switch {
+		case strings.ContainsRune("aeiouy", c):
+			vowels++
+			run = 0
+		case c >= '0' && c <= '9':
+			digits++
+			run = 0
+		case c >= 'a' && c <= 'z':
+			run++
+			if run > longestRun {
+				longestRun = run
+			}
+		default:
+			run = 0
+		}
+	}
+	length := float64(len(label))
+	vowelRatio := float64(vowels) / length
+	digitRatio := float64(digits) / length
+	indicators := 0
+	if vowelRatio < 0.25 {
+		indicators++
+	}
+	if longestRun >= 5 {
+		indicators++
+	}
+	if digitRatio > 0.1 && digitRatio < 0.9 {
+		indicators++
+	}
+	if calculateEntropy([]byte(label)) > 3.0 {
+		indicators++
+	}
+	return indicators >= 3
+}
+
+func (a *Analyzer) resetWindow(now time.Time) {
+	a.windowStart = now
+	a.subdomains = make(map[string]map[string]bool)
+	a.txtNull = make(map[string]int)
+	a.alerted = make(map[string]bool)
+}
+
+func (a *Analyzer) ignored(name string) bool {
+	for _, domain := range a.options.IgnoreDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Analyze scores the query and returns an alert when the score reaches alertScore, nil is returned for normal queries
+func (a *Analyzer) Analyze(entry *QueryLogEntry, question dns.Question) *Alert {
+	if !a.options.Enabled {
+		return nil
+	}
+	name := localName(question.Name)
+	if name == "." || a.ignored(name) {
+		return nil
+	}
+
+	labels := dns.SplitDomainName(name)
+	parent := parentDomain(labels)
+	score := 0
+	var reasons []string
+
+	// Tunnels carry the data in the labels below the parent domain
+	if len(name) > a.options.LongNameLength {
+		score += 15
+		reasons = append(reasons, fmt.Sprintf("long name (%d characters)", len(name)))
+	}
+	longLabel, highEntropy := false, false
+	var subLabels []string
+	if len(labels) > 2 {
+		subLabels = labels[:len(labels)-2]
+	}
+	for _, label := range subLabels {
+		if !longLabel && len(label) >= a.options.LongLabelLength {
+			longLabel = true
+			score += 25
+			reasons = append(reasons, fmt.Sprintf("long label (%d characters)", len(label)))
+		}
+		if !highEntropy && len(label) >= a.options.MinEntropyLength {
+			if entropy := calculateEntropy([]byte(label)); entropy >= a.options.EntropyThreshold {
+				highEntropy = true
+				score += 35
+				reasons = append(reasons, fmt.Sprintf("high entropy label (%.2f bits)", entropy))
+			}
+		}
+	}
+
+	// The registered name of a DGA domain is the label left of the top level domain
+	if len(labels) >= 2 && dgaLike(labels[len(labels)-2]) {
+		score += 50
+		reasons = append(reasons, fmt.Sprintf("algorithmically generated looking domain %s", parent))
+	}
+
+	a.mutex.Lock()
+	now := time.Now()
+	if now.Sub(a.windowStart) >= time.Duration(a.options.WindowMinutes)*time.Minute {
+		a.resetWindow(now)
+	}
+
+	if len(labels) > 2 {
+		seen := a.subdomains[parent]
+		if seen == nil {
+			seen = make(map[string]bool)
+			a.subdomains[parent] = seen
+		}
+		// Stop adding names once the threshold is passed so a tunnel can not use up the memory
+		if len(seen) <= a.options.UniqueSubdomains {
+			seen[name] = true
+		}
+		if len(seen) > a.options.UniqueSubdomains {
+			score += 50
+			reasons = append(reasons, fmt.Sprintf("more than %d unique subdomains of %s in %d minutes", a.options.UniqueSubdomains, parent, a.options.WindowMinutes))
+		}
+	}
+
+	if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeNULL {
+		a.txtNull[entry.ClientIP]++
+		if count := a.txtNull[entry.ClientIP]; count > a.options.TXTNullQueries {
+			score += 50
+			reasons = append(reasons, fmt.Sprintf("%d TXT and NULL queries from %s in %d minutes", count, entry.ClientIP, a.options.WindowMinutes))
+		}
+	}
+
+	if score < a.options.AlertScore {
+		a.mutex.Unlock()
+		return nil
+	}
+	// Only the first alert for a client and parent domain in the window is logged and sent to the webhook
+	alertKey := entry.ClientIP + " " + parent
+	firstAlert := !a.alerted[alertKey]
+	a.alerted[alertKey] = true
+	a.mutex.Unlock()
+
+	alert := &Alert{
+		Time:     entry.Time,
+		Server:   entry.Server,
+		ClientIP: entry.ClientIP,
+		QName:    entry.QName,
+		QType:    entry.QType,
+		Parent:   parent,
+		Score:    score,
+		Reasons:  reasons,
+	}
+	if firstAlert {
+		logMessage(fmt.Sprintf("Suspicious DNS query from %s for %s (score %d): %s", alert.ClientIP, alert.QName, alert.Score, strings.Join(reasons, ", ")), nil)
+		if a.webhook != nil {
+			// Drop the alert instead of holding up the query when the webhook is not keeping up
+			select {
+			case a.webhook <- alert:
+			default:
+			}
+		}
+	}
+	return alert
+}
+
+// sendWebhooks posts each alert as JSON to the webhook URL
+func (a *Analyzer) sendWebhooks() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for alert := range a.webhook {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			continue
+		}
+		response, err := client.Post(a.options.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logMessage("Failed to send the alert to the webhook", err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			logMessage(fmt.Sprintf("Webhook returned HTTP %d for the alert", response.StatusCode), nil)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://datatracker.ietf.org/doc/html/rfc2308#section-5 (Negative caching TTL from the SOA)
+
+const (
+	defaultCacheMaxEntries = 10000
+	defaultCacheMaxTTL     = 86400
+)
+
+type CacheConfig struct {
+	MaxEntries   int    `json:"maxEntries"`
+	MinTTL       uint32 `json:"minTTL"`
+	MaxTTL       uint32 `json:"maxTTL"`
+	StatsMinutes int    `json:"statsMinutes"` // How often the hit and miss counters are logged, 0 disables the log
+}
+
+// cacheKey separates the answers for each type and class of the same name
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type CacheEntry struct {
+	key        cacheKey
+	Response   *dns.Msg
+	Stored     time.Time
+	Expiration time.Time
+}
+
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Cache is a least recently used cache of upstream answers, the oldest entry is removed when maxEntries is reached
+type Cache struct {
+	mutex      sync.Mutex
+	entries    map[cacheKey]*list.Element
+	lru        *list.List // Front is the most recently used entry
+	maxEntries int
+	minTTL     uint32
+	maxTTL     uint32
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+func NewCache(options CacheConfig) *Cache {
+	c := &Cache{
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+		maxEntries: options.MaxEntries,
+		minTTL:     options.MinTTL,
+		maxTTL:     options.MaxTTL,
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultCacheMaxEntries
+	}
+	if c.maxTTL == 0 {
+		c.maxTTL = defaultCacheMaxTTL
+	}
+	return c
+}
+
+func newCacheKey(question dns.Question) cacheKey {
+	return cacheKey{name: localName(question.Name), qtype: question.Qtype, qclass: question.Qclass}
+}
+
+// cacheTTL returns how long the answer can be cached
+// Positive answers use the lowest TTL of the records, NXDOMAIN and NODATA use the SOA in the authority section
+// false is returned for answers that should not be cached
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		var ttl uint32
+		first := true
+		for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
+				if first || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+					first = false
+				}
+			}
+		}
+		return ttl, true
+	}
+
+	// NXDOMAIN or NODATA
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Get returns a copy of the cached answer with the TTLs lowered by the time spent in the cache
+func (c *Cache) Get(key cacheKey) (*dns.Msg, bool) {
+	c.mutex.Lock()
+	element, found := c.entries[key]
+	if !found {
+		c.mutex.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := element.Value.(*CacheEntry)
+	now := time.Now()
+	if !now.Before(entry.Expiration) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		c.mutex.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	c.mutex.Unlock()
+	c.hits.Add(1)
+
+	age := uint32(now.Sub(entry.Stored).Seconds())
+	msg := entry.Response.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return msg, true
+}
+
+// Set stores a copy of the answer until the TTL expires
+func (c *Cache) Set(key cacheKey, msg *dns.Msg) {
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &CacheEntry{
+		key:        key,
+		Response:   msg.Copy(),
+		Stored:     now,
+		Expiration: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, found := c.entries[key]; found {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*CacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// Flush removes every entry from the cache
+func (c *Cache) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mutex.Lock()
+	entries := c.lru.Len()
+	c.mutex.Unlock()
+	return CacheStats{
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://datatracker.ietf.org/doc/html/rfc7858 (DNS over TLS)
+// References: https://datatracker.ietf.org/doc/html/rfc8484 (DNS over HTTPS)
+
+const (
+	dohMediaType      = "application/dns-message"
+	defaultDoTAddress = ":853"
+	defaultDoHAddress = ":443"
+	defaultDoHPath    = "/dns-query"
+)
+
+type TLSConfig struct {
+	SSLConfig string `json:"sslConfig"`
+	SSLCert   string `json:"sslCert"`
+	SSLKey    string `json:"sslKey"`
+}
+
+type DoTConfig struct {
+	Enabled       bool   `json:"enabled"`
+	ListenAddress string `json:"listenAddress"`
+}
+
+type DoHConfig struct {
+	Enabled       bool   `json:"enabled"`
+	ListenAddress string `json:"listenAddress"`
+	Path          string `json:"path"`
+}
+
+// dohResponseWriter lets ServeDNS answer a DNS over HTTPS request the same way it answers UDP and TCP
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	reply      *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.reply = new(dns.Msg)
+	return len(b), w.reply.Unpack(b)
+}
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// tcpAddr parses the ip:port of the client from net/http so the DoH client is handled like a TCP client (no truncation)
+// The address is parsed and never resolved, a lookup could go back into this resolver
+func tcpAddr(ipPort string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(ipPort)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// localAddr is the address the DoH connection was accepted on, the Host header is set by the client
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// dohHandler accepts RFC 8484 GET (?dns=base64url) and POST (application/dns-message) requests
+func dohHandler(handler dns.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), dohMediaType) {
+				http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(wire) == 0 {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		query := new(dns.Msg)
+		if err := query.Unpack(wire); err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		dohWriter := &dohResponseWriter{
+			localAddr:  localAddr(r),
+			remoteAddr: tcpAddr(r.RemoteAddr),
+		}
+		handler.ServeDNS(dohWriter, query)
+		if dohWriter.reply == nil {
+			http.Error(w, "no answer", http.StatusBadGateway)
+			return
+		}
+
+		packed, err := dohWriter.reply.Pack()
+		if err != nil {
+			http.Error(w, "unable to pack the answer", http.StatusInternalServerError)
+			return
+		}
+
+		// The cache lifetime of the HTTP response follows the lowest TTL in the answer
+		maxAge := uint32(0)
+		for i, rr := range dohWriter.reply.Answer {
+			if i == 0 || rr.Header().Ttl < maxAge {
+				maxAge = rr.Header().Ttl
+			}
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+		w.Write(packed)
+	}
+}
+
+// upstreamTLSConfig verifies the certificate of the upstream against the host name, or tlsServerName if it is set
+func upstreamTLSConfig(host string, tlsServerName string) *tls.Config {
+	serverName := tlsServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// exchangeDoT sends the query to a tls://host:port upstream
+func exchangeDoT(r *dns.Msg, upstream UpstreamStruct, timeout time.Duration) (*dns.Msg, error) {
+	hostPort := strings.TrimPrefix(upstream.Address, "tls://")
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+		hostPort = net.JoinHostPort(hostPort, "853")
+	}
+
+	c := &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: upstreamTLSConfig(host, upstream.TLSServerName),
+		Timeout:   timeout,
+	}
+	resp, _, err := c.Exchange(r, hostPort)
+	return resp, err
+}
+
+// dohClients keeps one HTTP client per DoH upstream so the TLS connections are reused between queries
+var dohClients sync.Map
+
+func dohClient(upstreamURL *url.URL, upstream UpstreamStruct, timeout time.Duration) *http.Client {
+	if httpClient, found := dohClients.Load(upstream.Address); found {
+		return httpClient.(*http.Client)
+	}
+	httpClient := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: upstreamTLSConfig(upstreamURL.Hostname(), upstream.TLSServerName), ForceAttemptHTTP2: true},
+	}
+	actual, _ := dohClients.LoadOrStore(upstream.Address, httpClient)
+	return actual.(*http.Client)
+}
+
+// exchangeDoH sends the query to a https:// upstream with a POST, the ID is set to 0 so HTTP caches can be used
+func exchangeDoH(r *dns.Msg, upstream UpstreamStruct, timeout time.Duration) (*dns.Msg, error) {
+	upstreamURL, err := url.Parse(upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, upstream.Address, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", dohMediaType)
+	request.Header.Set("Accept", dohMediaType)
+
+	response, err := dohClient(upstreamURL, upstream, timeout).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream %s returned HTTP %d", upstream.Address, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = r.Id
+	return resp, nil
+}
+
+// loadServerCertificate reads the certificate and key used by the DoT and DoH listeners
+func loadServerCertificate() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.TLSOptions.SSLCert, config.TLSOptions.SSLKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// startDoT starts the DNS over TLS listener
+func startDoT(tlsConfig *tls.Config, handler dns.Handler, errChan chan error) {
+	listenAddress := config.DoTOptions.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultDoTAddress
+	}
+	server := &dns.Server{
+		Addr:      listenAddress,
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+	}
+	logMessage(fmt.Sprintf("Starting DNS over TLS server on %s", listenAddress), nil)
+	go func() {
+		errChan <- fmt.Errorf("DoT listener: %v", server.ListenAndServe())
+	}()
+}
+
+// startDoH starts the DNS over HTTPS listener
+func startDoH(tlsConfig *tls.Config, handler dns.Handler, errChan chan error) {
+	listenAddress := config.DoHOptions.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultDoHAddress
+	}
+	path := config.DoHOptions.Path
+	if path == "" {
+		path = defaultDoHPath
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, dohHandler(handler))
+	httpServer := &http.Server{
+		Addr:         listenAddress,
+		Handler:      mux,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	logMessage(fmt.Sprintf("Starting DNS over HTTPS server on %s%s", listenAddress, path), nil)
+	go func() {
+		errChan <- fmt.Errorf("DoH listener: %v", httpServer.ListenAndServeTLS("", ""))
+	}()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A single goroutine writes every log message and query log entry in the order they were received
+// The syslog connection and the log files stay open instead of being opened for every message
+
+const logChannelSize = 4096
+
+// logRecord is either a text message, a query log entry or a request to flush
+type logRecord struct {
+	message string
+	query   *QueryLogEntry
+	flushed chan bool
+}
+
+var logChan chan logRecord
+var queryTap *dnstapOutput
+
+// logMutex protects logChan from being closed while a message is sent, logClosed is set when closeLogs closed it
+// and logDone is closed by the writer after the last record was written
+var logMutex sync.RWMutex
+var logClosed bool
+var logDone chan bool
+
+// rotatingFile writes to logs/<base>-<date><ext>, a new file is started every day or when maxSize is reached
+type rotatingFile struct {
+	baseName  string
+	extension string
+	maxSize   int64 // Bytes, 0 disables the rotation by size
+	file      *os.File
+	date      string
+	size      int64
+}
+
+func (f *rotatingFile) fileName(date string, index int) string {
+	if index == 0 {
+		return filepath.Join("logs", fmt.Sprintf("%s-%s%s", f.baseName, date, f.extension))
+	}
+	return filepath.Join("logs", fmt.Sprintf("%s-%s.%d%s", f.baseName, date, index, f.extension))
+}
+
+// rotate closes the current file, moves it out of the way when it is full and opens the file for today
+func (f *rotatingFile) rotate(date string) error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	if date == f.date && f.maxSize > 0 && f.size >= f.maxSize {
+		index := 1
+		for {
+			if _, err := os.Stat(f.fileName(date, index)); os.IsNotExist(err) {
+				break
+			}
+			index++
+		}
+		if err := os.Rename(f.fileName(date, 0), f.fileName(date, index)); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(f.fileName(date, 0), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.date = date
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) WriteLine(line []byte) {
+	date := time.Now().Format("2006-01-02")
+	if f.file == nil || date != f.date || (f.maxSize > 0 && f.size+int64(len(line)) > f.maxSize && f.size > 0) {
+		if err := f.rotate(date); err != nil {
+			log.Printf("Failed to open log file: %v", err)
+			return
+		}
+	}
+	n, err := f.file.Write(append(line, '\n'))
+	f.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write log file: %v", err)
+	}
+}
+
+// syslogSender keeps the connection to the remote syslog server and reconnects after a failure
+type syslogSender struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogSender) Send(message string) {
+	if s.writer == nil {
+		writer, err := syslog.Dial("udp", config.SyslogOptions.SyslogServer, syslog.LOG_INFO|syslog.LOG_DAEMON, config.SyslogOptions.SyslogOriginName)
+		if err != nil {
+			log.Printf("Failed to connect to remote syslog server: %v", err)
+			return
+		}
+		s.writer = writer
+	}
+	if err := s.writer.Info(message); err != nil {
+		log.Printf("Failed to send to remote syslog server: %v", err)
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// startLogWriter starts the goroutine that writes the log messages, it is called once the config has been loaded
+func startLogWriter() {
+	logChan = make(chan logRecord, logChannelSize)
+	logDone = make(chan bool)
+	syslogEnabled := config.SyslogOptions.SyslogEnabled == "True"
+	saveFileEnabled := config.SaveFileOptions.SaveFileEnabled == "True"
+	queryLogEnabled := config.QueryLogOptions.Enabled
+
+	messageFile := &rotatingFile{
+		baseName:  config.SaveFileOptions.SaveFileBaseName,
+		extension: config.SaveFileOptions.SaveFileExtension,
+	}
+	queryFile := &rotatingFile{
+		baseName:  config.QueryLogOptions.FileBaseName,
+		extension: config.QueryLogOptions.FileExtension,
+		maxSize:   config.QueryLogOptions.MaxSizeMB * 1024 * 1024,
+	}
+	sender := &syslogSender{}
+	tap := newDnstapOutput(config.QueryLogOptions)
+	queryTap = tap
+
+	go func() {
+		defer close(logDone)
+		cleanup := time.Now()
+		for record := range logChan {
+			if record.flushed != nil {
+				record.flushed <- true
+				continue
+			}
+
+			// Remove old query logs once an hour
+			if config.QueryLogOptions.MaxAgeDays > 0 && time.Since(cleanup) > time.Hour {
+				cleanup = time.Now()
+				removeOldLogs(config.QueryLogOptions.FileBaseName, config.QueryLogOptions.MaxAgeDays)
+			}
+
+			if record.query != nil {
+				if queryLogEnabled {
+					line, err := json.Marshal(record.query)
+					if err != nil {
+						log.Printf("Failed to encode query log entry: %v", err)
+						continue
+					}
+					queryFile.WriteLine(line)
+					if syslogEnabled && config.QueryLogOptions.SendToSyslog {
+						sender.Send(string(line))
+					}
+				}
+				tap.Send(record.query)
+				continue
+			}
+
+			line := fmt.Sprintf("%s %s", time.Now().Format("2006/01/02 15:04:05"), record.message)
+			if syslogEnabled {
+				sender.Send(record.message)
+			}
+			if saveFileEnabled {
+				messageFile.WriteLine([]byte(line))
+			}
+		}
+	}()
+}
+
+// removeOldLogs deletes the rotated query logs older than the number of days
+func removeOldLogs(baseName string, days int) {
+	matches, err := filepath.Glob(filepath.Join("logs", baseName+"-*"))
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(match)
+		}
+	}
+}
+
+// flushLogs waits until every queued message has been written, used before the program exits
+func flushLogs() {
+	flushed := make(chan bool)
+	if !sendLog(logRecord{flushed: flushed}) {
+		return
+	}
+	<-flushed
+}
+
+// closeLogs stops the writer after the queued messages and closes the dnstap output, a dnstap file is only complete after it is closed
+// Queries answered after this are not logged, so nothing is sent to the closed dnstap output
+func closeLogs() {
+	logMutex.Lock()
+	if logChan == nil || logClosed {
+		logMutex.Unlock()
+		return
+	}
+	logClosed = true
+	close(logChan)
+	logMutex.Unlock()
+
+	<-logDone
+	if queryTap != nil && queryTap.output != nil {
+		queryTap.output.Close()
+	}
+}
+
+// sendLog queues the record for the writer, it returns false when the writer is not started or was stopped
+func sendLog(record logRecord) bool {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+	if logChan == nil || logClosed {
+		return false
+	}
+	logChan <- record
+	return true
+}
+
+func logMessage(message string, err error) {
+	if err != nil {
+		message = fmt.Sprintf("%s - %s: %v", config.ServerBanner, message, err)
+	} else {
+		message = fmt.Sprintf("%s - %s", config.ServerBanner, message)
+	}
+
+	// Messages logged before the writer is started or after it is stopped are printed to the console
+	if !sendLog(logRecord{message: message}) {
+		log.Println(message)
+	}
+}
+
+func logQuery(entry *QueryLogEntry) {
+	sendLog(logRecord{query: entry})
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"log/syslog"
-	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,12 +21,34 @@ import (
 var config Configuration
 
 type Configuration struct {
-	UpstreamDNS     string             `json:"upstreamDNS"`
-	ServerBanner    string             `json:"serverBanner"`
-	SyslogOptions   SyslogConfig       `json:"syslogOptions"`
-	SaveFileOptions SaveFileConfig     `json:"saveFileOptions"`
-	ARecords        []ARecordsStruct   `json:"aRecords"`
-	TXTRecords      []TXTRecordsStruct `json:"txtRecords"`
+	ListenAddress      string               `json:"listenAddress"`
+	EDNSBufferSize     uint16               `json:"ednsBufferSize"`
+	UpstreamDNS        string               `json:"upstreamDNS"`
+	UpstreamTLSName    string               `json:"upstreamTLSServerName"`
+	Upstreams          []UpstreamStruct     `json:"upstreams"`        // Used instead of upstreamDNS when it is set
+	UpstreamStrategy   string               `json:"upstreamStrategy"` // failover, round-robin or fastest
+	HealthCheckSeconds int                  `json:"healthCheckSeconds"`
+	HealthCheckName    string               `json:"healthCheckName"`
+	ServerBanner       string               `json:"serverBanner"`
+	SyslogOptions      SyslogConfig         `json:"syslogOptions"`
+	SaveFileOptions    SaveFileConfig       `json:"saveFileOptions"`
+	QueryLogOptions    QueryLogConfig       `json:"queryLogOptions"`
+	BlocklistOpts      BlocklistConfig      `json:"blocklistOptions"`
+	CacheOptions       CacheConfig          `json:"cacheOptions"`
+	AnalyzerOptions    AnalyzerConfig       `json:"analyzerOptions"`
+	AdminOptions       AdminConfig          `json:"adminOptions"`
+	WatchSeconds       int                  `json:"watchSeconds"` // Check the config, zone and blocklist files for changes, 0 only reloads on SIGHUP
+	TLSOptions         TLSConfig            `json:"tlsOptions"`
+	DoTOptions         DoTConfig            `json:"dotOptions"`
+	DoHOptions         DoHConfig            `json:"dohOptions"`
+	ZoneFiles          []ZoneFilesStruct    `json:"zoneFiles"`
+	LocalZones         []string             `json:"localZones"`
+	ARecords           []ARecordsStruct     `json:"aRecords"`
+	AAAARecords        []AAAARecordsStruct  `json:"aaaaRecords"`
+	CNAMERecords       []CNAMERecordsStruct `json:"cnameRecords"`
+	MXRecords          []MXRecordsStruct    `json:"mxRecords"`
+	SRVRecords         []SRVRecordsStruct   `json:"srvRecords"`
+	TXTRecords         []TXTRecordsStruct   `json:"txtRecords"`
 }
 
 type SyslogConfig struct {
@@ -49,49 +73,133 @@ type TXTRecordsStruct struct {
 	TXTMessage string `json:"txtMessage"`
 }
 
-type CacheEntry struct {
-	Response   *dns.Msg
-	Expiration time.Time
-}
-
 type DNSServer struct {
-	localRecords   map[string]string // Map of domain names to IP addresses
-	reverseRecords map[string]string // Map of IP addresses to domain names
-	txtRecords     map[string]string // Map of domain names to TXT records
-	upstreamDNS    string
-	cache          map[string]CacheEntry
+	localRecords   map[string]string             // Map of domain names to IP addresses
+	aaaaRecords    map[string]string             // Map of domain names to IPv6 addresses
+	cnameRecords   map[string]string             // Map of domain names to the canonical name
+	mxRecords      map[string][]MXRecordsStruct  // Map of domain names to mail exchangers
+	srvRecords     map[string][]SRVRecordsStruct // Map of service names to the SRV records
+	reverseRecords map[string]string             // Map of IP addresses to domain names
+	txtRecords     map[string]string             // Map of domain names to TXT records
+	localZones     []string                      // Zones served locally, missing names return NXDOMAIN instead of being forwarded
+	zones          []*Zone                       // Zones loaded from master zone files
+	policy         *Policy                       // Blocklists and response policy zones
+	upstreams      *UpstreamPool                 // Upstream DNS servers with their health
+	cache          *Cache                        // Upstream answers keyed by name, type and class
+	analyzer       *Analyzer                     // Scores queries for DNS tunnelling and generated domain names
+	recordConfig   Configuration                 // Configuration the records were loaded from, changed by the admin API
+	loaded         time.Time                     // When the records were last loaded or changed
+	started        time.Time
+	queries        atomic.Uint64
+	alerts         atomic.Uint64
+	modTimes       map[string]time.Time // Modification times of the watched files at the last reload
+	updateMutex    sync.Mutex           // Allows one reload or change from the admin API at a time
 	mutex          sync.RWMutex
 }
 
-func NewDNSServer(upstreamDNSString string) *DNSServer {
+// loadRecords builds the record maps, zones and blocklists from a configuration
+// The maps are built without holding the mutex, swapRecords replaces the maps in use by the server
+func loadRecords(c Configuration) (*DNSServer, error) {
 	aRecordsMap := make(map[string]string)
-	for _, item := range config.ARecords {
-		aRecordsMap[item.AName] = item.IP
-		aNameItems := strings.Split(item.AName, ".") // Configures the A Record resolution to allow the lookup of www with the aName of www.site.name
-		if len(aNameItems) > 1 {
+	for _, item := range c.ARecords {
+		aName := localName(item.AName)
+		aRecordsMap[aName] = item.IP
+		aNameItems := strings.Split(aName, ".") // Configures the A Record resolution to allow the lookup of www with the aName of www.site.name
+		if len(aNameItems) > 2 {
 			aRecordsMap[aNameItems[0]+"."] = item.IP
 		}
 	}
 
+	aaaaRecordsMap := make(map[string]string)
+	for _, item := range c.AAAARecords {
+		aaaaName := localName(item.AAAAName)
+		aaaaRecordsMap[aaaaName] = item.IP
+		aaaaNameItems := strings.Split(aaaaName, ".") // Same short name lookup as the A Records
+		if len(aaaaNameItems) > 2 {
+			aaaaRecordsMap[aaaaNameItems[0]+"."] = item.IP
+		}
+	}
+
 	ptrRecordsMap := make(map[string]string)
-	for _, item := range config.ARecords {
+	for _, item := range c.ARecords {
 		octets := strings.Split(item.IP, ".")
+		if len(octets) != 4 {
+			logMessage(fmt.Sprintf("Skipping PTR record for invalid IP Address %s", item.IP), nil)
+			continue
+		}
 		reverseIPAddressString := fmt.Sprintf("%s.%s.%s.%s.in-addr.arpa.", octets[3], octets[2], octets[1], octets[0])
-		ptrRecordsMap[reverseIPAddressString] = item.AName
+		ptrRecordsMap[reverseIPAddressString] = dns.Fqdn(item.AName)
+	}
+	for _, item := range c.AAAARecords {
+		reverseIPAddressString := reverseName(item.IP)
+		if reverseIPAddressString == "" {
+			logMessage(fmt.Sprintf("Skipping PTR record for invalid IP Address %s", item.IP), nil)
+			continue
+		}
+		ptrRecordsMap[reverseIPAddressString] = dns.Fqdn(item.AAAAName)
+	}
+
+	cnameRecordsMap := make(map[string]string)
+	for _, item := range c.CNAMERecords {
+		cnameRecordsMap[localName(item.CNAMEName)] = dns.Fqdn(item.Target)
+	}
+
+	mxRecordsMap := make(map[string][]MXRecordsStruct)
+	for _, item := range c.MXRecords {
+		item.Exchange = dns.Fqdn(item.Exchange)
+		mxRecordsMap[localName(item.MXName)] = append(mxRecordsMap[localName(item.MXName)], item)
+	}
+
+	srvRecordsMap := make(map[string][]SRVRecordsStruct)
+	for _, item := range c.SRVRecords {
+		item.Target = dns.Fqdn(item.Target)
+		srvRecordsMap[localName(item.SRVName)] = append(srvRecordsMap[localName(item.SRVName)], item)
 	}
 
 	txtRecordsMap := make(map[string]string)
-	for _, item := range config.TXTRecords {
-		txtRecordsMap[item.TXTName] = item.TXTMessage
+	for _, item := range c.TXTRecords {
+		txtRecordsMap[localName(item.TXTName)] = item.TXTMessage
+	}
+
+	var localZones []string
+	for _, zone := range c.LocalZones {
+		localZones = append(localZones, localName(zone))
+	}
+
+	zones, err := loadZones(c.ZoneFiles)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the zone files: %v", err)
+	}
+
+	policy, err := loadPolicy(c.BlocklistOpts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the blocklists: %v", err)
 	}
 
 	return &DNSServer{
+		zones:          zones,
+		policy:         policy,
 		localRecords:   aRecordsMap,
+		aaaaRecords:    aaaaRecordsMap,
+		cnameRecords:   cnameRecordsMap,
+		mxRecords:      mxRecordsMap,
+		srvRecords:     srvRecordsMap,
 		reverseRecords: ptrRecordsMap,
 		txtRecords:     txtRecordsMap,
-		upstreamDNS:    upstreamDNSString,
-		cache:          make(map[string]CacheEntry),
-	}
+		localZones:     localZones,
+	}, nil
+}
+
+func NewDNSServer(upstreams *UpstreamPool) *DNSServer {
+	s, err := loadRecords(config)
+	cf.CheckError("Unable to load the records", err, true)
+	s.upstreams = upstreams
+	s.cache = NewCache(config.CacheOptions)
+	s.analyzer = NewAnalyzer(config.AnalyzerOptions)
+	s.recordConfig = config
+	s.started = time.Now()
+	s.loaded = s.started
+	return s
 }
 
 func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
@@ -100,175 +208,96 @@ func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
+	entry := newQueryLogEntry(w, r, time.Now())
+	entry.Alert = s.analyzer.Analyze(entry, r.Question[0])
+	s.queries.Add(1)
+	if entry.Alert != nil {
+		s.alerts.Add(1)
+	}
+	msg := s.handleQuery(r, entry)
+	var reply *dns.Msg
+	if msg != nil {
+		reply = writeReply(w, r, msg)
+	}
+	entry.finish(reply)
+	logQuery(entry)
+}
+
+// handleQuery returns the answer for the query and records where it came from in the query log entry
+// nil is returned when the query should not be answered
+func (s *DNSServer) handleQuery(r *dns.Msg, entry *QueryLogEntry) *dns.Msg {
 	question := r.Question[0]
 	queryName := question.Name
-	logMessage(fmt.Sprintf("Received query: %s", queryName), nil)
 
+	// Local records are answered before the cache so answers for different types of the same name are not mixed up
 	s.mutex.RLock()
-	cacheEntry, found := s.cache[queryName]
+	msg, handled, chaseName := s.answerLocal(r)
 	s.mutex.RUnlock()
 
-	if found && time.Now().Before(cacheEntry.Expiration) {
-		logMessage(fmt.Sprintf("Cache hit for %s", queryName), nil)
-		w.WriteMsg(cacheEntry.Response)
-		return
-	}
-
-	if question.Qtype == dns.TypeA {
-		s.mutex.RLock()
-		localIP, found := s.localRecords[queryName]
-		s.mutex.RUnlock()
-
-		if found {
-			logMessage(fmt.Sprintf("Serving local domain: %s -> %s", queryName, localIP), nil)
-			msg := new(dns.Msg)
-			msg.SetReply(r)
-			msg.Authoritative = true
-
-			aRecord := &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    60,
-				},
-				A: net.ParseIP(localIP),
-			}
-			msg.Answer = append(msg.Answer, aRecord)
-
-			s.mutex.Lock()
-			s.cache[queryName] = CacheEntry{
-				Response:   msg,
-				Expiration: time.Now().Add(60 * time.Second),
-			}
-			s.mutex.Unlock()
-
-			w.WriteMsg(msg)
-			return
+	if handled {
+		entry.Source = sourceLocal
+		if chaseName != "" {
+			entry.Upstream = s.chaseCNAME(msg, chaseName, question.Qtype)
 		}
-	} else if question.Qtype == dns.TypePTR {
-		s.mutex.RLock()
-		domainName, found := s.reverseRecords[queryName]
-		s.mutex.RUnlock()
-
-		if found {
-			logMessage(fmt.Sprintf("Serving reverse lookup: %s -> %s", queryName, domainName), nil)
-			msg := new(dns.Msg)
-			msg.SetReply(r)
-			msg.Authoritative = true
-
-			ptrRecord := &dns.PTR{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypePTR,
-					Class:  dns.ClassINET,
-					Ttl:    60,
-				},
-				Ptr: domainName,
-			}
-			msg.Answer = append(msg.Answer, ptrRecord)
-
-			s.mutex.Lock()
-			s.cache[queryName] = CacheEntry{
-				Response:   msg,
-				Expiration: time.Now().Add(60 * time.Second),
-			}
-			s.mutex.Unlock()
-
-			w.WriteMsg(msg)
-			return
-		}
-	} else if question.Qtype == dns.TypeTXT {
-		s.mutex.RLock()
-		txtRecord, found := s.txtRecords[queryName]
-		s.mutex.RUnlock()
-
-		if found {
-			logMessage(fmt.Sprintf("Serving TXT record: %s -> %s", queryName, txtRecord), nil)
-			msg := new(dns.Msg)
-			msg.SetReply(r)
-			msg.Authoritative = true
-
-			txt := &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    60,
-				},
-				Txt: []string{txtRecord},
-			}
-			msg.Answer = append(msg.Answer, txt)
+		return msg
+	}
 
-			s.mutex.Lock()
-			s.cache[queryName] = CacheEntry{
-				Response:   msg,
-				Expiration: time.Now().Add(60 * time.Second),
-			}
-			s.mutex.Unlock()
+	// Blocklists are checked after the local records so the lab names can not be blocked by a list
+	// The policy is kept for the sinkhole options, a reload can replace s.policy after the lock is released
+	s.mutex.RLock()
+	policy := s.policy
+	rule, blocked := policy.Match(queryName)
+	s.mutex.RUnlock()
 
-			w.WriteMsg(msg)
-			return
+	if blocked {
+		entry.Source = sourceBlocked
+		entry.Reason = rule.action + ": " + rule.reason
+		msg, target := s.policyAnswer(r, rule, policy)
+		if msg != nil && target != "" {
+			s.followTarget(msg, target, question.Qtype)
 		}
+		return msg
 	}
 
-	logMessage(fmt.Sprintf("Forwarding query for %s to upstream DNS %s", queryName, config.UpstreamDNS), nil)
-	c := new(dns.Client)
-	resp, _, err := c.Exchange(r, s.upstreamDNS)
-	if err != nil {
-		logMessage(fmt.Sprintln("Failed to forward query"), err)
-		return
+	key := newCacheKey(question)
+	if cached, found := s.cache.Get(key); found {
+		entry.Source = sourceCache
+		return cached
 	}
 
-	s.mutex.Lock()
-	s.cache[queryName] = CacheEntry{
-		Response:   resp,
-		Expiration: time.Now().Add(60 * time.Second),
-	}
-	s.mutex.Unlock()
-
-	w.WriteMsg(resp)
-}
-
-func logToFile(message string) {
-	currentDate := time.Now().Format("2006-01-02")
-	fileName := fmt.Sprintf("logs/%s-%s%s", config.SaveFileOptions.SaveFileBaseName, currentDate, config.SaveFileOptions.SaveFileExtension)
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	entry.Source = sourceUpstream
+	resp, upstream, err := s.upstreams.Exchange(r)
+	entry.Upstream = upstream
 	if err != nil {
-		log.Printf("Failed to open log file: %v", err)
-		return
+		// The client gets SERVFAIL instead of waiting for its own timeout when every upstream has failed
+		entry.Reason = err.Error()
+		logMessage(fmt.Sprintf("Failed to forward query for %s", queryName), err)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		return msg
 	}
-	defer file.Close()
 
-	logger := log.New(file, "", log.LstdFlags)
-	logger.Println(message)
+	s.cache.Set(key, resp)
+	return resp
 }
 
-func logToSyslog(message string) {
-	logger, err := syslog.Dial("udp", config.SyslogOptions.SyslogServer, syslog.LOG_INFO|syslog.LOG_DAEMON, config.SyslogOptions.SyslogOriginName)
-	if err != nil {
-		log.Printf("Failed to connect to remote syslog server: %v", err)
-		return
-	}
-	defer logger.Close()
+// chaseCNAME resolves the target of a local CNAME record upstream and appends the answers to the local reply
+// The upstream that answered is returned for the query log
+func (s *DNSServer) chaseCNAME(msg *dns.Msg, chaseName string, qtype uint16) string {
+	logMessage(fmt.Sprintf("Resolving CNAME target %s upstream", chaseName), nil)
+	query := new(dns.Msg)
+	query.SetQuestion(chaseName, qtype)
+	query.RecursionDesired = true
 
-	logger.Info(message)
-}
-
-func logMessage(message string, err error) {
-	dnsServerBanner := config.ServerBanner
-	if config.SyslogOptions.SyslogEnabled == "True" && err != nil {
-		go logToSyslog(fmt.Sprintf("%s - %s: %v", dnsServerBanner, message, err))
-	} else {
-		go logToSyslog(fmt.Sprintf("%s - %s", dnsServerBanner, message))
-	}
-
-	if config.SaveFileOptions.SaveFileEnabled == "True" && err != nil {
-		go logToFile(fmt.Sprintf("%s - %s: %v", dnsServerBanner, message, err))
-	} else {
-		go logToFile(fmt.Sprintf("%s - %s", dnsServerBanner, message))
+	resp, upstream, err := s.upstreams.Exchange(query)
+	if err != nil {
+		logMessage(fmt.Sprintf("Failed to resolve CNAME target %s", chaseName), err)
+		msg.Rcode = dns.RcodeServerFailure
+		return upstream
 	}
-
+	msg.Answer = append(msg.Answer, resp.Answer...)
+	msg.Rcode = resp.Rcode
+	return upstream
 }
 
 func main() {
@@ -278,6 +307,7 @@ func main() {
 	// Load config.json file
 	log.Println("Loading the following config file: " + *ConfigPtr + "\n")
 	//go logToSyslog(fmt.Sprintf("Loading the following config file: %s\n", *ConfigPtr))
+	configPath = *ConfigPtr
 	configFile, err := os.Open(*ConfigPtr)
 	cf.CheckError("Unable to open the configuration file", err, true)
 	defer configFile.Close()
@@ -287,24 +317,75 @@ func main() {
 		cf.CheckError("Unable to decode the configuration file", err, true)
 	}
 
-	upstreamDNS := config.UpstreamDNS
+	// Start writing the logs before anything else logs a message
+	cf.CreateDirectory("/logs")
+	startLogWriter()
+
+	upstreams := NewUpstreamPool(upstreamList(), config.UpstreamStrategy)
+	upstreams.StartHealthChecks(config.HealthCheckSeconds, config.HealthCheckName)
 
-	dnsServer := NewDNSServer(upstreamDNS)
+	dnsServer := NewDNSServer(upstreams)
 	dns.HandleFunc(".", dnsServer.ServeDNS)
+	dnsServer.StartReloaders(config.WatchSeconds)
 
-	server := &dns.Server{
-		Addr: ":53",
-		Net:  "udp",
+	listenAddress := config.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
 	}
 
-	cf.CreateDirectory("/logs")
+	// The DoT, DoH and admin API listeners use the self-signed certificate created the same way as the sslReverseProxy
+	var tlsConfig *tls.Config
+	if config.DoTOptions.Enabled || config.DoHOptions.Enabled || (config.AdminOptions.Enabled && config.AdminOptions.UseTLS) {
+		cf.CreateDirectory("/keys")
+
+		// Does the certConfig.json  file exist in the keys folder
+		if !cf.FileExists("/" + config.TLSOptions.SSLConfig) {
+			cf.CreateCertConfigFile()
+			logMessage("WARNING: Created keys/certConfig.json, modify the values to create the self-signed cert to be utilized", nil)
+			closeLogs()
+			os.Exit(0)
+		}
 
-	m := fmt.Sprintln("Starting DNS server on UDP 53")
-	logMessage(m, nil)
-	m = fmt.Sprintf("Upstream DNS Server: %s\n", config.UpstreamDNS)
+		// Does the server.crt and server.key files exist in the keys folder
+		if !cf.FileExists("/" + config.TLSOptions.SSLCert) {
+			cf.CreateCerts()
+			if !cf.FileExists("/" + config.TLSOptions.SSLKey) {
+				logMessage("WARNING: Failed to create server.crt and server.key files for a self-signed certificate", nil)
+				closeLogs()
+				os.Exit(0)
+			}
+		}
+
+		tlsConfig, err = loadServerCertificate()
+		cf.CheckError("Unable to load the certificate for DoT, DoH and the admin API", err, true)
+	}
+
+	// Log the cache counters so the hit rate can be followed in Elastic
+	if config.CacheOptions.StatsMinutes > 0 {
+		go func() {
+			for range time.Tick(time.Duration(config.CacheOptions.StatsMinutes) * time.Minute) {
+				stats := dnsServer.cache.Stats()
+				logMessage(fmt.Sprintf("Cache stats: entries: %d hits: %d misses: %d evictions: %d", stats.Entries, stats.Hits, stats.Misses, stats.Evictions), nil)
+			}
+		}()
+	}
+
+	// Write the queued logs before stopping
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logMessage(fmt.Sprintf("Stopping DNS Server after %v", sig), nil)
+		closeLogs()
+		os.Exit(0)
+	}()
+
+	m := fmt.Sprintf("Upstream DNS Servers (%s): %s\n", upstreams.strategy, upstreams.Addresses())
 	logMessage(m, nil)
-	if err := server.ListenAndServe(); err != nil {
+	// The UDP and TCP listeners run until one of them fails
+	if err := startListeners(listenAddress, dns.DefaultServeMux, tlsConfig, dnsServer); err != nil {
 		//log.Fatalf("Failed to start DNS server: %v", err)
 		logMessage("Failed to start DNS Server", err)
+		closeLogs()
 	}
 }
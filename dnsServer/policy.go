@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz (Response Policy Zones)
+// References: https://github.com/StevenBlack/hosts (hosts file format blocklists)
+
+// Actions that a policy rule can take
+const (
+	actionNXDomain = "nxdomain"
+	actionNoData   = "nodata"
+	actionSinkhole = "sinkhole"
+	actionCNAME    = "cname"
+	actionLocal    = "local" // RPZ local data, the records in the policy zone are returned
+	actionPassthru = "passthru"
+	actionDrop     = "drop"
+)
+
+type BlocklistConfig struct {
+	Enabled      bool                  `json:"enabled"`
+	Action       string                `json:"action"` // nxdomain, nodata, sinkhole or cname for the hosts and domains lists
+	SinkholeIPv4 string                `json:"sinkholeIPv4"`
+	SinkholeIPv6 string                `json:"sinkholeIPv6"`
+	CNAMETarget  string                `json:"cnameTarget"`
+	AllowList    []string              `json:"allowList"`
+	Lists        []BlocklistFileStruct `json:"lists"`
+}
+
+type BlocklistFileStruct struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Format string `json:"format"` // hosts, domains or rpz
+	Zone   string `json:"zone"`   // Origin of the RPZ file
+}
+
+// policyRule is the action to take for a blocked name and why it was blocked
+type policyRule struct {
+	action  string
+	target  string   // CNAME target for the cname action
+	records []dns.RR // RPZ local data
+	reason  string
+}
+
+// Policy holds the blocked names loaded from the lists
+type Policy struct {
+	exact     map[string]*policyRule // Rules for the name only
+	wildcard  map[string]*policyRule // Rules for every name below the domain
+	allowList []string
+	options   BlocklistConfig
+}
+
+func newPolicy(options BlocklistConfig) *Policy {
+	p := &Policy{
+		exact:    make(map[string]*policyRule),
+		wildcard: make(map[string]*policyRule),
+		options:  options,
+	}
+	for _, item := range options.AllowList {
+		p.allowList = append(p.allowList, localName(item))
+	}
+	return p
+}
+
+// defaultRule returns the rule used for the entries in the hosts and domains lists
+func (p *Policy) defaultRule(reason string) *policyRule {
+	rule := &policyRule{action: strings.ToLower(p.options.Action), reason: reason}
+	switch rule.action {
+	case actionSinkhole, actionNoData:
+	case actionCNAME:
+		rule.target = dns.Fqdn(p.options.CNAMETarget)
+	default:
+		rule.action = actionNXDomain
+	}
+	return rule
+}
+
+// addRule keeps the first rule loaded for a name so the order of the lists decides the priority
+func addRule(rules map[string]*policyRule, name string, rule *policyRule) bool {
+	if _, found := rules[name]; found {
+		return false
+	}
+	rules[name] = rule
+	return true
+}
+
+// loadHosts reads a hosts file (0.0.0.0 ads.example.com), only the exact names are blocked
+func (p *Policy) loadHosts(item BlocklistFileStruct) (int, error) {
+	listFile, err := os.Open(item.File)
+	if err != nil {
+		return 0, err
+	}
+	defer listFile.Close()
+
+	count := 0
+	lineNumber := 0
+	scanner := bufio.NewScanner(listFile)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			switch host {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "0.0.0.0":
+				continue
+			}
+			if strings.HasPrefix(host, "ip6-") {
+				continue
+			}
+			if addRule(p.exact, localName(host), p.defaultRule(fmt.Sprintf("%s line %d: %s", item.Name, lineNumber, host))) {
+				count++
+			}
+		}
+	}
+	return count, scanner.Err()
+}
+
+// loadDomains reads a list with one domain per line
+// example.com and ||example.com^ block the domain and everything below it, *.example.com only blocks the names below it
+func (p *Policy) loadDomains(item BlocklistFileStruct) (int, error) {
+	listFile, err := os.Open(item.File)
+	if err != nil {
+		return 0, err
+	}
+	defer listFile.Close()
+
+	count := 0
+	lineNumber := 0
+	scanner := bufio.NewScanner(listFile)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		line = strings.Fields(line)[0]
+		rule := p.defaultRule(fmt.Sprintf("%s line %d: %s", item.Name, lineNumber, line))
+
+		switch {
+		case strings.HasPrefix(line, "*."):
+			if addRule(p.wildcard, localName(line[2:]), rule) {
+				count++
+			}
+		default:
+			domain := strings.TrimSuffix(strings.TrimPrefix(line, "||"), "^")
+			if _, ok := dns.IsDomainName(domain); !ok {
+				continue
+			}
+			addRule(p.exact, localName(domain), rule)
+			if addRule(p.wildcard, localName(domain), rule) {
+				count++
+			}
+		}
+	}
+	return count, scanner.Err()
+}
+
+// loadRPZ reads a Response Policy Zone, only QNAME triggers are supported
+func (p *Policy) loadRPZ(item BlocklistFileStruct) (int, error) {
+	listFile, err := os.Open(item.File)
+	if err != nil {
+		return 0, err
+	}
+	defer listFile.Close()
+
+	origin := localName(item.Zone)
+	count := 0
+	skipped := 0
+	zp := dns.NewZoneParser(listFile, origin, item.File)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeSOA || header.Rrtype == dns.TypeNS {
+			continue
+		}
+		owner := localName(header.Name)
+		if !dns.IsSubDomain(origin, owner) || owner == origin {
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, origin)
+
+		// IP, NSDNAME and NSIP triggers are not supported
+		if strings.Contains(trigger, ".rpz-") {
+			skipped++
+			continue
+		}
+
+		rules := p.exact
+		if strings.HasPrefix(trigger, "*.") {
+			rules = p.wildcard
+			trigger = trigger[2:]
+		}
+
+		rule := &policyRule{reason: fmt.Sprintf("%s: %s", item.Name, strings.TrimSuffix(owner, "."+origin))}
+		if cname, isCNAME := rr.(*dns.CNAME); isCNAME {
+			switch cname.Target {
+			case ".":
+				rule.action = actionNXDomain
+			case "*.":
+				rule.action = actionNoData
+			case "rpz-passthru.":
+				rule.action = actionPassthru
+			case "rpz-drop.":
+				rule.action = actionDrop
+			case "rpz-tcp-only.":
+				skipped++
+				continue
+			default:
+				rule.action = actionCNAME
+				rule.target = cname.Target
+			}
+			if addRule(rules, trigger, rule) {
+				count++
+			}
+			continue
+		}
+
+		// Local data, more than one record can exist for the trigger
+		if existing, found := rules[trigger]; found {
+			if existing.action == actionLocal {
+				existing.records = append(existing.records, rr)
+			}
+			continue
+		}
+		rule.action = actionLocal
+		rule.records = []dns.RR{rr}
+		rules[trigger] = rule
+		count++
+	}
+	if skipped > 0 {
+		logMessage(fmt.Sprintf("Skipped %d unsupported RPZ triggers in %s", skipped, item.File), nil)
+	}
+	return count, zp.Err()
+}
+
+// allowed returns true if the name or one of its parents is in the allow list
+func (p *Policy) allowed(name string) bool {
+	for _, domain := range p.allowList {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the rule for the name, the most specific rule wins
+func (p *Policy) Match(name string) (*policyRule, bool) {
+	name = localName(name)
+	if p.allowed(name) {
+		return nil, false
+	}
+
+	if rule, found := p.exact[name]; found {
+		return rule, rule.action != actionPassthru
+	}
+	for parent := parentName(name); parent != "."; parent = parentName(parent) {
+		if rule, found := p.wildcard[parent]; found {
+			return rule, rule.action != actionPassthru
+		}
+	}
+	return nil, false
+}
+
+// policyAnswer builds the reply for a blocked query
+// The returned string is the CNAME target that still needs to be resolved, nil is returned for the drop action
+// The sinkhole addresses are read from the policy that matched the rule
+func (s *DNSServer) policyAnswer(r *dns.Msg, rule *policyRule, policy *Policy) (*dns.Msg, string) {
+	question := r.Question[0]
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	switch rule.action {
+	case actionDrop:
+		return nil, ""
+	case actionNoData:
+	case actionSinkhole:
+		if question.Qtype == dns.TypeA && policy.options.SinkholeIPv4 != "" {
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: rrHeader(question.Name, dns.TypeA), A: net.ParseIP(policy.options.SinkholeIPv4)})
+		}
+		if question.Qtype == dns.TypeAAAA && policy.options.SinkholeIPv6 != "" {
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: rrHeader(question.Name, dns.TypeAAAA), AAAA: net.ParseIP(policy.options.SinkholeIPv6)})
+		}
+	case actionCNAME:
+		msg.Answer = append(msg.Answer, &dns.CNAME{Hdr: rrHeader(question.Name, dns.TypeCNAME), Target: rule.target})
+		if question.Qtype != dns.TypeCNAME {
+			return msg, rule.target
+		}
+	case actionLocal:
+		for _, rr := range rule.records {
+			if rr.Header().Rrtype == question.Qtype {
+				msg.Answer = append(msg.Answer, withOwner([]dns.RR{rr}, question.Name)...)
+			}
+		}
+	default:
+		msg.Rcode = dns.RcodeNameError
+	}
+	return msg, ""
+}
+
+// loadPolicy loads every list in the blocklist options
+func loadPolicy(options BlocklistConfig) (*Policy, error) {
+	p := newPolicy(options)
+	if !options.Enabled {
+		return p, nil
+	}
+
+	// An address that does not parse would be answered as a record without data
+	if ip := net.ParseIP(options.SinkholeIPv4); options.SinkholeIPv4 != "" && (ip == nil || ip.To4() == nil) {
+		return nil, fmt.Errorf("sinkholeIPv4 %q is not an IPv4 address", options.SinkholeIPv4)
+	}
+	if ip := net.ParseIP(options.SinkholeIPv6); options.SinkholeIPv6 != "" && (ip == nil || ip.To4() != nil) {
+		return nil, fmt.Errorf("sinkholeIPv6 %q is not an IPv6 address", options.SinkholeIPv6)
+	}
+
+	for _, item := range options.Lists {
+		if item.Name == "" {
+			item.Name = item.File
+		}
+
+		var count int
+		var err error
+		switch strings.ToLower(item.Format) {
+		case "hosts":
+			count, err = p.loadHosts(item)
+		case "rpz":
+			count, err = p.loadRPZ(item)
+		default:
+			count, err = p.loadDomains(item)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("blocklist %s: %v", item.File, err)
+		}
+		logMessage(fmt.Sprintf("Loaded %d blocklist rules from %s", count, item.Name), nil)
+	}
+	return p, nil
+}
+
+// followTarget resolves the CNAME target of a policy rule from the local records or the upstream DNS server
+func (s *DNSServer) followTarget(msg *dns.Msg, target string, qtype uint16) {
+	query := new(dns.Msg)
+	query.SetQuestion(target, qtype)
+
+	s.mutex.RLock()
+	local, handled, chaseName := s.answerLocal(query)
+	s.mutex.RUnlock()
+
+	if !handled {
+		s.chaseCNAME(msg, target, qtype)
+		return
+	}
+	msg.Answer = append(msg.Answer, local.Answer...)
+	msg.Rcode = local.Rcode
+	if chaseName != "" {
+		s.chaseCNAME(msg, chaseName, qtype)
+	}
+}
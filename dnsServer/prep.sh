@@ -12,7 +12,9 @@ go env -w GO111MODULE='auto'
 # Install Dependencies
 go get github.com/thepcn3rd/goAdvsCommonFunctions
 go get github.com/miekg/dns
+go get github.com/dnstap/golang-dnstap
+go get google.golang.org/protobuf
 
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" main.go
-#GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" main.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" .
+#GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" .
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// References: https://dnstap.info/ (dnstap message format)
+// References: https://www.elastic.co/guide/en/ecs/current/ecs-dns.html (Field names used in Elastic for DNS events)
+
+// Where the answer for a query came from
+const (
+	sourceLocal    = "local"
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+	sourceBlocked  = "blocked"
+)
+
+type QueryLogConfig struct {
+	Enabled       bool   `json:"enabled"`
+	FileBaseName  string `json:"fileBaseName"`
+	FileExtension string `json:"fileExtension"`
+	MaxSizeMB     int64  `json:"maxSizeMB"`    // Start a new file when the current file reaches the size, 0 only rotates by date
+	MaxAgeDays    int    `json:"maxAgeDays"`   // Remove query logs older than the number of days, 0 keeps every file
+	SendToSyslog  bool   `json:"sendToSyslog"` // Send the JSON lines to the syslog server in syslogOptions
+	DnstapEnabled bool   `json:"dnstapEnabled"`
+	DnstapNetwork string `json:"dnstapNetwork"` // unix, tcp or file
+	DnstapAddress string `json:"dnstapAddress"`
+}
+
+// QueryLogEntry is written as one JSON line for every query
+type QueryLogEntry struct {
+	Time       string  `json:"time"`
+	Server     string  `json:"server"`
+	ClientIP   string  `json:"clientIP"`
+	ClientPort int     `json:"clientPort"`
+	Protocol   string  `json:"protocol"`
+	QName      string  `json:"qname"`
+	QType      string  `json:"qtype"`
+	QClass     string  `json:"qclass"`
+	RCode      string  `json:"rcode"`
+	Answers    int     `json:"answers"`
+	Truncated  bool    `json:"truncated,omitempty"`
+	Source     string  `json:"source"`
+	Reason     string  `json:"reason,omitempty"`
+	Upstream   string  `json:"upstream,omitempty"`
+	LatencyMs  float64 `json:"latencyMs"`
+	Alert      *Alert  `json:"alert,omitempty"` // Set when the analyzer flags the query
+
+	// Kept for dnstap, not written to the JSON log
+	start      time.Time
+	clientAddr net.Addr
+	localAddr  net.Addr
+	query      *dns.Msg
+	reply      *dns.Msg
+}
+
+// clientProtocol returns how the query reached the server
+func clientProtocol(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "doh"
+	}
+	if isUDP(w) {
+		return "udp"
+	}
+	if stater, ok := w.(dns.ConnectionStater); ok && stater.ConnectionState() != nil {
+		return "dot"
+	}
+	return "tcp"
+}
+
+func newQueryLogEntry(w dns.ResponseWriter, r *dns.Msg, start time.Time) *QueryLogEntry {
+	entry := &QueryLogEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		Server:     config.ServerBanner,
+		Protocol:   clientProtocol(w),
+		start:      start,
+		clientAddr: w.RemoteAddr(),
+		localAddr:  w.LocalAddr(),
+		query:      r,
+	}
+	if host, port, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		entry.ClientIP = host
+		entry.ClientPort, _ = strconv.Atoi(port)
+	}
+	if len(r.Question) > 0 {
+		entry.QName = r.Question[0].Name
+		entry.QType = dns.TypeToString[r.Question[0].Qtype]
+		entry.QClass = dns.ClassToString[r.Question[0].Qclass]
+	}
+	return entry
+}
+
+// finish records the reply that was sent, reply is nil when no answer was sent
+func (entry *QueryLogEntry) finish(reply *dns.Msg) {
+	entry.LatencyMs = float64(time.Since(entry.start).Microseconds()) / 1000
+	entry.reply = reply
+	if reply == nil {
+		entry.RCode = "NOANSWER"
+		return
+	}
+	entry.RCode = dns.RcodeToString[reply.Rcode]
+	entry.Answers = len(reply.Answer)
+	entry.Truncated = reply.Truncated
+}
+
+// dnstapOutput sends CLIENT_QUERY and CLIENT_RESPONSE messages to a dnstap collector
+type dnstapOutput struct {
+	output dnstap.Output
+}
+
+func newDnstapOutput(options QueryLogConfig) *dnstapOutput {
+	tap := &dnstapOutput{}
+	if !options.DnstapEnabled {
+		return tap
+	}
+
+	var output dnstap.Output
+	var err error
+	switch strings.ToLower(options.DnstapNetwork) {
+	case "file":
+		output, err = dnstap.NewFrameStreamOutputFromFilename(options.DnstapAddress)
+	case "tcp":
+		var addr *net.TCPAddr
+		addr, err = net.ResolveTCPAddr("tcp", options.DnstapAddress)
+		if err == nil {
+			output, err = dnstap.NewFrameStreamSockOutput(addr)
+		}
+	default:
+		output, err = dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: options.DnstapAddress, Net: "unix"})
+	}
+	if err != nil {
+		log.Printf("Failed to start the dnstap output: %v", err)
+		return tap
+	}
+
+	go output.RunOutputLoop()
+	tap.output = output
+	return tap
+}
+
+// socketInfo converts the client address to the dnstap fields
+func socketInfo(addr net.Addr, protocol string) (dnstap.SocketFamily, dnstap.SocketProtocol, []byte, uint32) {
+	family := dnstap.SocketFamily_INET
+	socketProtocol := dnstap.SocketProtocol_UDP
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+		socketProtocol = dnstap.SocketProtocol_TCP
+	}
+	switch protocol {
+	case "dot":
+		socketProtocol = dnstap.SocketProtocol_DOT
+	case "doh":
+		socketProtocol = dnstap.SocketProtocol_DOH
+	}
+	if ip.To4() == nil {
+		family = dnstap.SocketFamily_INET6
+	} else {
+		ip = ip.To4()
+	}
+	return family, socketProtocol, ip, uint32(port)
+}
+
+func (tap *dnstapOutput) Send(entry *QueryLogEntry) {
+	if tap.output == nil {
+		return
+	}
+
+	family, socketProtocol, clientIP, clientPort := socketInfo(entry.clientAddr, entry.Protocol)
+	_, _, serverIP, serverPort := socketInfo(entry.localAddr, entry.Protocol)
+	queryTime := uint64(entry.start.Unix())
+	queryNsec := uint32(entry.start.Nanosecond())
+
+	queryWire, _ := entry.query.Pack()
+	messages := []*dnstap.Message{{
+		Type:            dnstap.Message_CLIENT_QUERY.Enum(),
+		SocketFamily:    family.Enum(),
+		SocketProtocol:  socketProtocol.Enum(),
+		QueryAddress:    clientIP,
+		QueryPort:       &clientPort,
+		ResponseAddress: serverIP,
+		ResponsePort:    &serverPort,
+		QueryTimeSec:    &queryTime,
+		QueryTimeNsec:   &queryNsec,
+		QueryMessage:    queryWire,
+	}}
+
+	if entry.reply != nil {
+		responseTime := entry.start.Add(time.Duration(entry.LatencyMs * float64(time.Millisecond)))
+		responseSec := uint64(responseTime.Unix())
+		responseNsec := uint32(responseTime.Nanosecond())
+		responseWire, _ := entry.reply.Pack()
+		messages = append(messages, &dnstap.Message{
+			Type:             dnstap.Message_CLIENT_RESPONSE.Enum(),
+			SocketFamily:     family.Enum(),
+			SocketProtocol:   socketProtocol.Enum(),
+			QueryAddress:     clientIP,
+			QueryPort:        &clientPort,
+			ResponseAddress:  serverIP,
+			ResponsePort:     &serverPort,
+			QueryTimeSec:     &queryTime,
+			QueryTimeNsec:    &queryNsec,
+			ResponseTimeSec:  &responseSec,
+			ResponseTimeNsec: &responseNsec,
+			ResponseMessage:  responseWire,
+		})
+	}
+
+	for _, message := range messages {
+		frame, err := proto.Marshal(&dnstap.Dnstap{
+			Type:     dnstap.Dnstap_MESSAGE.Enum(),
+			Identity: []byte(config.ServerBanner),
+			Version:  []byte("dnsServer"),
+			Message:  message,
+		})
+		if err != nil {
+			log.Printf("Failed to encode dnstap message: %v", err)
+			return
+		}
+		// Drop the frame instead of holding up the query log when the collector is not keeping up
+		select {
+		case tap.output.GetOutputChannel() <- frame:
+		default:
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of CNAME records followed inside the local records before giving up
+const maxCNAMEChain = 8
+
+type AAAARecordsStruct struct {
+	AAAAName string `json:"aaaaName"`
+	IP       string `json:"ip"`
+}
+
+type CNAMERecordsStruct struct {
+	CNAMEName string `json:"cnameName"`
+	Target    string `json:"target"`
+}
+
+type MXRecordsStruct struct {
+	MXName     string `json:"mxName"`
+	Preference uint16 `json:"preference"`
+	Exchange   string `json:"exchange"`
+}
+
+type SRVRecordsStruct struct {
+	SRVName  string `json:"srvName"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+// localName lower cases the name and makes sure it ends with a . so the maps can be searched the same way the queries arrive
+func localName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for an IP Address
+func reverseName(ip string) string {
+	reverseIPAddressString, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return reverseIPAddressString
+}
+
+func rrHeader(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    60,
+	}
+}
+
+// nameExists returns true if any type of record exists locally for the name
+func (s *DNSServer) nameExists(name string) bool {
+	if _, found := s.localRecords[name]; found {
+		return true
+	}
+	if _, found := s.aaaaRecords[name]; found {
+		return true
+	}
+	if _, found := s.cnameRecords[name]; found {
+		return true
+	}
+	if _, found := s.mxRecords[name]; found {
+		return true
+	}
+	if _, found := s.srvRecords[name]; found {
+		return true
+	}
+	if _, found := s.txtRecords[name]; found {
+		return true
+	}
+	if _, found := s.reverseRecords[name]; found {
+		return true
+	}
+	return false
+}
+
+// inLocalZone returns true if the name is equal to or below one of the configured local zones
+func (s *DNSServer) inLocalZone(name string) bool {
+	for _, zone := range s.localZones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// localAnswers returns the records of the requested type that exist locally for the name
+// owner is the name placed in the answer, it keeps the case the client used in the question
+func (s *DNSServer) localAnswers(owner string, name string, qtype uint16) []dns.RR {
+	var answers []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		if localIP, found := s.localRecords[name]; found {
+			answers = append(answers, &dns.A{Hdr: rrHeader(owner, dns.TypeA), A: net.ParseIP(localIP)})
+		}
+	case dns.TypeAAAA:
+		if localIP, found := s.aaaaRecords[name]; found {
+			answers = append(answers, &dns.AAAA{Hdr: rrHeader(owner, dns.TypeAAAA), AAAA: net.ParseIP(localIP)})
+		}
+	case dns.TypePTR:
+		if domainName, found := s.reverseRecords[name]; found {
+			answers = append(answers, &dns.PTR{Hdr: rrHeader(owner, dns.TypePTR), Ptr: domainName})
+		}
+	case dns.TypeTXT:
+		if txtRecord, found := s.txtRecords[name]; found {
+			answers = append(answers, &dns.TXT{Hdr: rrHeader(owner, dns.TypeTXT), Txt: []string{txtRecord}})
+		}
+	case dns.TypeCNAME:
+		if target, found := s.cnameRecords[name]; found {
+			answers = append(answers, &dns.CNAME{Hdr: rrHeader(owner, dns.TypeCNAME), Target: target})
+		}
+	case dns.TypeMX:
+		for _, item := range s.mxRecords[name] {
+			answers = append(answers, &dns.MX{Hdr: rrHeader(owner, dns.TypeMX), Preference: item.Preference, Mx: item.Exchange})
+		}
+	case dns.TypeSRV:
+		for _, item := range s.srvRecords[name] {
+			answers = append(answers, &dns.SRV{Hdr: rrHeader(owner, dns.TypeSRV), Priority: item.Priority, Weight: item.Weight, Port: item.Port, Target: item.Target})
+		}
+	}
+	return answers
+}
+
+// additionalAnswers adds the local A and AAAA records for the targets of MX and SRV records
+func (s *DNSServer) additionalAnswers(answers []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range answers {
+		var target string
+		switch record := rr.(type) {
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		default:
+			continue
+		}
+		extra = append(extra, s.addressRecords(target)...)
+	}
+	return extra
+}
+
+// addressRecords returns the local A and AAAA records for a name from the zones or the configured records
+func (s *DNSServer) addressRecords(target string) []dns.RR {
+	var extra []dns.RR
+	target = localName(target)
+	if z := s.findZone(target); z != nil {
+		extra = append(extra, z.lookup(target, target, dns.TypeA).answers...)
+		extra = append(extra, z.lookup(target, target, dns.TypeAAAA).answers...)
+		return extra
+	}
+	extra = append(extra, s.localAnswers(target, target, dns.TypeA)...)
+	extra = append(extra, s.localAnswers(target, target, dns.TypeAAAA)...)
+	return extra
+}
+
+// answerLocal builds the reply from the zone files and the local records
+// handled is false when nothing about the name is known locally and the query should be forwarded
+// chaseName is set when a CNAME chain leaves the local records, the caller resolves it upstream and appends the answers
+func (s *DNSServer) answerLocal(r *dns.Msg) (msg *dns.Msg, handled bool, chaseName string) {
+	question := r.Question[0]
+	name := localName(question.Name)
+	owner := question.Name
+
+	msg = new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	for depth := 0; depth <= maxCNAMEChain; depth++ {
+		// Zone files are authoritative for every name below the origin
+		if z := s.findZone(name); z != nil {
+			target := s.answerZone(msg, z, owner, name, question.Qtype)
+			if target == "" {
+				return msg, true, ""
+			}
+			name = localName(target)
+			owner = target
+			continue
+		}
+
+		// Follow the CNAME unless the CNAME itself was requested
+		if target, found := s.cnameRecords[name]; found && question.Qtype != dns.TypeCNAME {
+			msg.Answer = append(msg.Answer, &dns.CNAME{Hdr: rrHeader(owner, dns.TypeCNAME), Target: target})
+			name = localName(target)
+			owner = target
+			continue
+		}
+
+		answers := s.localAnswers(owner, name, question.Qtype)
+		if len(answers) > 0 {
+			msg.Answer = append(msg.Answer, answers...)
+			msg.Extra = append(msg.Extra, s.additionalAnswers(answers)...)
+			return msg, true, ""
+		}
+
+		// NODATA, the name exists locally but not with the requested type
+		if s.nameExists(name) {
+			return msg, true, ""
+		}
+
+		// NXDOMAIN, the name is inside a zone that is served locally
+		if s.inLocalZone(name) {
+			msg.Rcode = dns.RcodeNameError
+			return msg, true, ""
+		}
+
+		// The CNAME chain points outside of the local records
+		if depth > 0 {
+			msg.Authoritative = false
+			return msg, true, owner
+		}
+
+		return nil, false, ""
+	}
+
+	logMessage(fmt.Sprintf("CNAME chain for %s is longer than %d records", question.Name, maxCNAMEChain), nil)
+	msg.Answer = nil
+	msg.Rcode = dns.RcodeServerFailure
+	return msg, true, ""
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The records, zone files, local zones and blocklists can be reloaded without a restart
+// The other options (listeners, upstreams, cache, logs) are only read when the server starts
+
+// configPath is the configuration file loaded at startup, it is read again on a reload
+var configPath string
+
+func readConfig(path string) (Configuration, error) {
+	var c Configuration
+	configFile, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer configFile.Close()
+	err = json.NewDecoder(configFile).Decode(&c)
+	return c, err
+}
+
+// writeConfig saves the records changed with the admin API so they are kept after a restart
+// The whole file is written from the Configuration, the formatting and unknown keys of the file are not kept
+func writeConfig(path string, c Configuration) error {
+	jsonData, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, jsonData, 0644)
+}
+
+// copyConfig returns a copy that does not share the record slices, so a failed change does not modify the records in use
+func copyConfig(c Configuration) (Configuration, error) {
+	var copied Configuration
+	jsonData, err := json.Marshal(c)
+	if err != nil {
+		return copied, err
+	}
+	err = json.Unmarshal(jsonData, &copied)
+	return copied, err
+}
+
+// swapRecords replaces the records in use with the records in next while holding the mutex
+// Queries either see all of the old records or all of the new records
+func (s *DNSServer) swapRecords(next *DNSServer, c Configuration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.localRecords = next.localRecords
+	s.aaaaRecords = next.aaaaRecords
+	s.cnameRecords = next.cnameRecords
+	s.mxRecords = next.mxRecords
+	s.srvRecords = next.srvRecords
+	s.reverseRecords = next.reverseRecords
+	s.txtRecords = next.txtRecords
+	s.localZones = next.localZones
+	s.zones = next.zones
+	s.policy = next.policy
+	s.recordConfig = c
+	s.loaded = time.Now()
+}
+
+// Reload reads the configuration file and the files it references again
+// The records in use are kept when the new configuration has an error
+func (s *DNSServer) Reload() error {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	c, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	next, err := loadRecords(c)
+	if err != nil {
+		return err
+	}
+	s.swapRecords(next, c)
+	s.modTimes = fileModTimes(c)
+	logMessage(fmt.Sprintf("Reloaded the records from %s", configPath), nil)
+	return nil
+}
+
+// updateRecords applies a change from the admin API to a copy of the configuration and swaps in the new records
+func (s *DNSServer) updateRecords(change func(c *Configuration) error) error {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	s.mutex.RLock()
+	c, err := copyConfig(s.recordConfig)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := change(&c); err != nil {
+		return err
+	}
+	next, err := loadRecords(c)
+	if err != nil {
+		return err
+	}
+	s.swapRecords(next, c)
+
+	if config.AdminOptions.SaveChanges {
+		if err := writeConfig(configPath, c); err != nil {
+			return fmt.Errorf("records changed but not saved: %v", err)
+		}
+		// The saved file already matches the records, the watcher does not need to reload it
+		s.modTimes = fileModTimes(c)
+	}
+	return nil
+}
+
+// watchedFiles are the files that change the records
+func watchedFiles(c Configuration) []string {
+	files := []string{configPath}
+	for _, zone := range c.ZoneFiles {
+		files = append(files, zone.Files...)
+	}
+	if c.BlocklistOpts.Enabled {
+		for _, list := range c.BlocklistOpts.Lists {
+			files = append(files, list.File)
+		}
+	}
+	return files
+}
+
+func fileModTimes(c Configuration) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range watchedFiles(c) {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed returns true when a watched file was modified, added or removed since the last reload
+func (s *DNSServer) changed() bool {
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+	s.mutex.RLock()
+	current := fileModTimes(s.recordConfig)
+	s.mutex.RUnlock()
+
+	if len(current) != len(s.modTimes) {
+		return true
+	}
+	for file, modTime := range current {
+		if !modTime.Equal(s.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartReloaders reloads the records on SIGHUP, and when watchSeconds is set checks the files for changes
+func (s *DNSServer) StartReloaders(watchSeconds int) {
+	s.updateMutex.Lock()
+	s.modTimes = fileModTimes(s.recordConfig)
+	s.updateMutex.Unlock()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			logMessage("Received SIGHUP, reloading the records", nil)
+			if err := s.Reload(); err != nil {
+				logMessage("Failed to reload the records, keeping the current records", err)
+			}
+		}
+	}()
+
+	if watchSeconds <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(watchSeconds) * time.Second) {
+			if !s.changed() {
+				continue
+			}
+			logMessage("Configuration files changed, reloading the records", nil)
+			if err := s.Reload(); err != nil {
+				logMessage("Failed to reload the records, keeping the current records", err)
+				// Do not try the same broken files again until they change
+				s.updateMutex.Lock()
+				s.mutex.RLock()
+				s.modTimes = fileModTimes(s.recordConfig)
+				s.mutex.RUnlock()
+				s.updateMutex.Unlock()
+			}
+		}
+	}()
+}
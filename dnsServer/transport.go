@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://datatracker.ietf.org/doc/html/rfc6891 (EDNS0)
+// References: https://datatracker.ietf.org/doc/html/rfc7766 (DNS over TCP)
+// References: https://www.dnsflagday.net/2020/ (1232 byte default buffer size)
+
+const (
+	defaultListenAddress  = ":53"
+	defaultEDNSBufferSize = 1232
+)
+
+// isUDP returns true when the query arrived over UDP, only UDP answers are limited in size
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// ednsBufferSize returns the largest UDP payload the server will send
+func ednsBufferSize() uint16 {
+	if config.EDNSBufferSize < dns.MinMsgSize {
+		return defaultEDNSBufferSize
+	}
+	return config.EDNSBufferSize
+}
+
+// writeReply sends a copy of the reply to the client and returns the copy that was sent
+// The ID and question are taken from the query so cached answers can be reused, EDNS0 is only returned if the client sent it,
+// and over UDP the answer is truncated to the client buffer size with the TC bit set so the client retries over TCP
+func writeReply(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) *dns.Msg {
+	reply := msg.Copy()
+	reply.Id = r.Id
+	reply.Question = r.Question
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		if size > int(ednsBufferSize()) {
+			size = int(ednsBufferSize())
+		}
+		// Replace the OPT record from upstream with the buffer size of this server
+		if replyOpt := reply.IsEdns0(); replyOpt != nil {
+			replyOpt.SetUDPSize(ednsBufferSize())
+		} else {
+			reply.SetEdns0(ednsBufferSize(), opt.Do())
+		}
+	} else {
+		// Remove the OPT record, a client that did not send EDNS0 must not receive it
+		var extra []dns.RR
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	}
+
+	if isUDP(w) {
+		reply.Truncate(size)
+		if reply.Truncated {
+			logMessage(fmt.Sprintf("Truncated answer for %s to %d bytes", r.Question[0].Name, size), nil)
+		}
+	} else {
+		reply.Truncated = false
+		reply.Compress = true
+	}
+
+	if err := w.WriteMsg(reply); err != nil {
+		logMessage(fmt.Sprintf("Failed to write the answer for %s", r.Question[0].Name), err)
+	}
+	return reply
+}
+
+// exchangeUpstream sends the query to the upstream DNS server
+// tls:// upstreams use DNS over TLS, https:// upstreams use DNS over HTTPS and anything else is sent over UDP with a retry over TCP if the answer is truncated
+func exchangeUpstream(r *dns.Msg, upstream UpstreamStruct, timeout time.Duration) (*dns.Msg, error) {
+	switch {
+	case strings.HasPrefix(upstream.Address, "tls://"):
+		return exchangeDoT(r, upstream, timeout)
+	case strings.HasPrefix(upstream.Address, "https://"):
+		return exchangeDoH(r, upstream, timeout)
+	}
+
+	c := &dns.Client{Timeout: timeout}
+	resp, _, err := c.Exchange(r, upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Truncated {
+		logMessage(fmt.Sprintf("Upstream answer for %s was truncated, retrying over TCP", r.Question[0].Name), nil)
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(r, upstream.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// startListeners starts the UDP and TCP servers on the same address, and the DoT, DoH and admin API servers if they are enabled
+// The first error from any of the listeners is returned
+func startListeners(listenAddress string, handler dns.Handler, tlsConfig *tls.Config, server *DNSServer) error {
+	errChan := make(chan error, 5)
+	for _, network := range []string{"udp", "tcp"} {
+		dnsSrv := &dns.Server{
+			Addr:    listenAddress,
+			Net:     network,
+			Handler: handler,
+			UDPSize: int(ednsBufferSize()),
+		}
+		logMessage(fmt.Sprintf("Starting DNS server on %s %s", network, listenAddress), nil)
+		go func(dnsSrv *dns.Server) {
+			errChan <- fmt.Errorf("%s listener: %v", dnsSrv.Net, dnsSrv.ListenAndServe())
+		}(dnsSrv)
+	}
+
+	if config.DoTOptions.Enabled {
+		startDoT(tlsConfig, handler, errChan)
+	}
+	if config.DoHOptions.Enabled {
+		startDoH(tlsConfig, handler, errChan)
+	}
+	if config.AdminOptions.Enabled {
+		startAdmin(server, tlsConfig, errChan)
+	}
+	return <-errChan
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies to pick the upstream DNS server for a query
+const (
+	strategyFailover   = "failover"
+	strategyRoundRobin = "round-robin"
+	strategyFastest    = "fastest"
+)
+
+const (
+	defaultUpstreamTimeoutMs  = 2000
+	defaultHealthCheckSeconds = 30
+	defaultHealthCheckName    = "."
+	unhealthyAfterFailures    = 3 // Consecutive failures before an upstream is skipped until it passes a health check
+)
+
+type UpstreamStruct struct {
+	Address       string `json:"address"` // 8.8.8.8:53, tls://1.1.1.1:853 or https://cloudflare-dns.com/dns-query
+	TimeoutMs     int    `json:"timeoutMs"`
+	TLSServerName string `json:"tlsServerName"`
+}
+
+type UpstreamStatus struct {
+	Address  string  `json:"address"`
+	Healthy  bool    `json:"healthy"`
+	RTTMs    float64 `json:"rttMs"`
+	Queries  uint64  `json:"queries"`
+	Failures uint64  `json:"failures"`
+}
+
+// upstream keeps the health of a single upstream DNS server
+type upstream struct {
+	UpstreamStruct
+	timeout             time.Duration
+	healthy             atomic.Bool
+	rtt                 atomic.Int64 // Moving average of the round trip time in nanoseconds
+	consecutiveFailures atomic.Int64
+	queries             atomic.Uint64
+	failures            atomic.Uint64
+}
+
+// UpstreamPool sends queries to the upstream DNS servers with the configured strategy
+type UpstreamPool struct {
+	upstreams []*upstream
+	strategy  string
+	next      atomic.Uint64
+}
+
+// upstreamList returns the upstreams from the config, upstreamDNS is used when the list is empty
+func upstreamList() []UpstreamStruct {
+	if len(config.Upstreams) > 0 {
+		return config.Upstreams
+	}
+	return []UpstreamStruct{{Address: config.UpstreamDNS, TLSServerName: config.UpstreamTLSName}}
+}
+
+func NewUpstreamPool(upstreams []UpstreamStruct, strategy string) *UpstreamPool {
+	p := &UpstreamPool{strategy: strings.ToLower(strategy)}
+	switch p.strategy {
+	case strategyRoundRobin, strategyFastest:
+	default:
+		p.strategy = strategyFailover
+	}
+
+	for _, item := range upstreams {
+		if item.Address == "" {
+			continue
+		}
+		u := &upstream{UpstreamStruct: item, timeout: time.Duration(item.TimeoutMs) * time.Millisecond}
+		if item.TimeoutMs <= 0 {
+			u.timeout = defaultUpstreamTimeoutMs * time.Millisecond
+		}
+		u.healthy.Store(true)
+		p.upstreams = append(p.upstreams, u)
+	}
+	return p
+}
+
+// order returns the upstreams in the order they are tried, healthy upstreams are always tried first
+func (p *UpstreamPool) order() []*upstream {
+	ordered := make([]*upstream, len(p.upstreams))
+	copy(ordered, p.upstreams)
+
+	switch p.strategy {
+	case strategyRoundRobin:
+		if len(ordered) > 0 {
+			start := int(p.next.Add(1)-1) % len(ordered)
+			ordered = append(ordered[start:], ordered[:start]...)
+		}
+	case strategyFastest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].rtt.Load() < ordered[j].rtt.Load()
+		})
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].healthy.Load() && !ordered[j].healthy.Load()
+	})
+	return ordered
+}
+
+func (u *upstream) success(rtt time.Duration) {
+	u.consecutiveFailures.Store(0)
+	if !u.healthy.Swap(true) {
+		logMessage(fmt.Sprintf("Upstream DNS %s is healthy", u.Address), nil)
+	}
+	// The first measurement is used as is, after that the average moves 1/4 of the way to the new value
+	previous := u.rtt.Load()
+	if previous == 0 {
+		u.rtt.Store(int64(rtt))
+	} else {
+		u.rtt.Store(previous + (int64(rtt)-previous)/4)
+	}
+}
+
+func (u *upstream) failure(err error) {
+	u.failures.Add(1)
+	if u.consecutiveFailures.Add(1) >= unhealthyAfterFailures && u.healthy.Swap(false) {
+		logMessage(fmt.Sprintf("Upstream DNS %s is unhealthy", u.Address), err)
+	}
+}
+
+// exchange sends the query to a single upstream, SERVFAIL and REFUSED answers are treated as a failure
+func (u *upstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	start := time.Now()
+	resp, err := exchangeUpstream(r, u.UpstreamStruct, u.timeout)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("upstream answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		u.failure(err)
+		return resp, err
+	}
+	u.success(time.Since(start))
+	return resp, nil
+}
+
+// Exchange tries the upstreams until one answers, the address of the upstream that answered is returned
+func (p *UpstreamPool) Exchange(r *dns.Msg) (*dns.Msg, string, error) {
+	var lastErr error
+	var errs []string
+	for _, u := range p.order() {
+		resp, err := u.exchange(r)
+		if err == nil {
+			return resp, u.Address, nil
+		}
+		lastErr = err
+		errs = append(errs, fmt.Sprintf("%s: %v", u.Address, err))
+	}
+	if lastErr == nil {
+		return nil, "", fmt.Errorf("no upstream DNS servers configured")
+	}
+	return nil, "", fmt.Errorf("all upstream DNS servers failed (%s)", strings.Join(errs, ", "))
+}
+
+// HealthCheck sends a query to every upstream so an unhealthy upstream is used again once it recovers
+func (p *UpstreamPool) HealthCheck(name string) {
+	for _, u := range p.upstreams {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(name), dns.TypeNS)
+		u.exchange(query)
+	}
+}
+
+// StartHealthChecks runs the health check in the background
+func (p *UpstreamPool) StartHealthChecks(seconds int, name string) {
+	if seconds <= 0 {
+		seconds = defaultHealthCheckSeconds
+	}
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+	go func() {
+		for range time.Tick(time.Duration(seconds) * time.Second) {
+			p.HealthCheck(name)
+		}
+	}()
+}
+
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	var status []UpstreamStatus
+	for _, u := range p.upstreams {
+		status = append(status, UpstreamStatus{
+			Address:  u.Address,
+			Healthy:  u.healthy.Load(),
+			RTTMs:    float64(time.Duration(u.rtt.Load()).Microseconds()) / 1000,
+			Queries:  u.queries.Load(),
+			Failures: u.failures.Load(),
+		})
+	}
+	return status
+}
+
+// Addresses returns the upstream addresses for the log messages
+func (p *UpstreamPool) Addresses() string {
+	var addresses []string
+	for _, u := range p.upstreams {
+		addresses = append(addresses, u.Address)
+	}
+	return strings.Join(addresses, ", ")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// References: https://datatracker.ietf.org/doc/html/rfc1035#section-5 (Master files)
+// References: https://datatracker.ietf.org/doc/html/rfc4592 (Wildcards)
+// References: https://datatracker.ietf.org/doc/html/rfc2308 (Negative caching TTL from the SOA)
+
+type ZoneFilesStruct struct {
+	Zone  string   `json:"zone"`
+	Files []string `json:"files"`
+}
+
+// Zone holds the records loaded from one or more master zone files for a single origin
+type Zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string]map[uint16][]dns.RR // Map of owner names to the records by type
+	names   map[string]bool                // Every owner name and the empty non-terminals between the owner names and the origin
+}
+
+// zoneResult describes what a zone knows about a name and type
+type zoneResult struct {
+	answers  []dns.RR
+	cname    *dns.CNAME
+	referral []dns.RR // NS records of a delegation below the origin
+	exists   bool
+}
+
+// LoadZone parses the master files for the zone, $ORIGIN, $TTL and $INCLUDE are handled by the parser
+func LoadZone(origin string, files []string) (*Zone, error) {
+	z := &Zone{
+		origin:  localName(origin),
+		records: make(map[string]map[uint16][]dns.RR),
+		names:   make(map[string]bool),
+	}
+
+	for _, fileName := range files {
+		zoneFile, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		zp := dns.NewZoneParser(zoneFile, z.origin, fileName)
+		zp.SetIncludeAllowed(true)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			z.add(rr)
+		}
+		err = zp.Err()
+		zoneFile.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %s does not have a SOA record", z.origin)
+	}
+
+	return z, nil
+}
+
+func (z *Zone) add(rr dns.RR) {
+	name := localName(rr.Header().Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		logMessage(fmt.Sprintf("Skipping record outside of zone %s: %s", z.origin, rr.String()), nil)
+		return
+	}
+
+	if soa, ok := rr.(*dns.SOA); ok {
+		if name != z.origin {
+			logMessage(fmt.Sprintf("Skipping SOA record that is not at the apex of zone %s: %s", z.origin, rr.String()), nil)
+			return
+		}
+		z.soa = soa
+	}
+
+	if z.records[name] == nil {
+		z.records[name] = make(map[uint16][]dns.RR)
+	}
+	z.records[name][rr.Header().Rrtype] = append(z.records[name][rr.Header().Rrtype], rr)
+
+	// Mark the owner name and the empty non-terminals so they return NODATA instead of NXDOMAIN
+	for n := name; n != z.origin; n = parentName(n) {
+		z.names[n] = true
+	}
+	z.names[z.origin] = true
+}
+
+// parentName removes the first label from the name
+func parentName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+// negativeSOA returns the SOA for the authority section of NXDOMAIN and NODATA answers
+// The TTL is the lower of the SOA TTL and the SOA minimum field
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// delegation returns the NS records if the name is at or below a zone cut inside the zone
+func (z *Zone) delegation(name string) []dns.RR {
+	var cut []dns.RR
+	for n := name; n != z.origin && n != "."; n = parentName(n) {
+		if ns, found := z.records[n][dns.TypeNS]; found {
+			cut = ns
+		}
+	}
+	return cut
+}
+
+// glue returns the address records for a name server below a zone cut, lookup would return the referral instead
+func (z *Zone) glue(name string) []dns.RR {
+	var extra []dns.RR
+	name = localName(name)
+	extra = append(extra, z.records[name][dns.TypeA]...)
+	extra = append(extra, z.records[name][dns.TypeAAAA]...)
+	return extra
+}
+
+// withOwner copies the records and sets the owner name used in the answer
+func withOwner(rrs []dns.RR, owner string) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range rrs {
+		c := dns.Copy(rr)
+		c.Header().Name = owner
+		answers = append(answers, c)
+	}
+	return answers
+}
+
+// lookup finds the records of the requested type for the name, expanding wildcards when the name does not exist
+func (z *Zone) lookup(owner string, name string, qtype uint16) zoneResult {
+	var result zoneResult
+
+	if ns := z.delegation(name); ns != nil {
+		result.referral = ns
+		return result
+	}
+
+	set, found := z.records[name]
+	if !found {
+		if z.names[name] {
+			result.exists = true
+			return result
+		}
+		// Find the closest encloser and check for a wildcard below it
+		encloser := parentName(name)
+		for !z.names[encloser] && encloser != z.origin && encloser != "." {
+			encloser = parentName(encloser)
+		}
+		set, found = z.records["*."+encloser]
+		if !found {
+			return result
+		}
+	}
+
+	result.exists = true
+	if cname, ok := set[dns.TypeCNAME]; ok && qtype != dns.TypeCNAME {
+		result.cname = withOwner(cname, owner)[0].(*dns.CNAME)
+		return result
+	}
+	if qtype == dns.TypeANY {
+		for _, rrs := range set {
+			result.answers = append(result.answers, withOwner(rrs, owner)...)
+		}
+		return result
+	}
+	result.answers = withOwner(set[qtype], owner)
+	return result
+}
+
+// findZone returns the most specific zone loaded for the name
+func (s *DNSServer) findZone(name string) *Zone {
+	var match *Zone
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.origin, name) && (match == nil || dns.CountLabel(z.origin) > dns.CountLabel(match.origin)) {
+			match = z
+		}
+	}
+	return match
+}
+
+// answerZone fills in the reply from the zone
+// The returned string is the CNAME target to follow, it is empty when the reply is complete
+func (s *DNSServer) answerZone(msg *dns.Msg, z *Zone, owner string, name string, qtype uint16) string {
+	result := z.lookup(owner, name, qtype)
+	switch {
+	case result.referral != nil:
+		msg.Authoritative = false
+		msg.Ns = append(msg.Ns, result.referral...)
+		for _, rr := range result.referral {
+			msg.Extra = append(msg.Extra, z.glue(rr.(*dns.NS).Ns)...)
+		}
+	case result.cname != nil:
+		msg.Answer = append(msg.Answer, result.cname)
+		return result.cname.Target
+	case len(result.answers) > 0:
+		msg.Answer = append(msg.Answer, result.answers...)
+		msg.Extra = append(msg.Extra, s.additionalAnswers(result.answers)...)
+	case result.exists:
+		msg.Ns = append(msg.Ns, z.negativeSOA())
+	default:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = append(msg.Ns, z.negativeSOA())
+	}
+	return ""
+}
+
+// loadZones loads every zone listed in the configuration
+func loadZones(zoneFiles []ZoneFilesStruct) ([]*Zone, error) {
+	var zones []*Zone
+	for _, item := range zoneFiles {
+		z, err := LoadZone(item.Zone, item.Files)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %v", item.Zone, err)
+		}
+		recordCount := 0
+		for _, set := range z.records {
+			for _, rrs := range set {
+				recordCount += len(rrs)
+			}
+		}
+		logMessage(fmt.Sprintf("Loaded zone %s with %d records from %s", z.origin, recordCount, strings.Join(item.Files, ", ")), nil)
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
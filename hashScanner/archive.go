@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archives and OOXML documents (.docx, .xlsx, .pptx) are opened and the files within are scanned
+// A finding in an archive has the location archive.zip!inner/path, nested archives add another !
+// gzip and bzip2 only compress a single file, so they do not add to the location (logs.tar.gz!var/log/auth.log)
+
+const (
+	archiveNone = iota
+	archiveZip
+	archiveTar
+	archiveGzip
+	archiveBzip2
+)
+
+const (
+	defaultMaxArchiveDepth = 5         // Each zip, tar, gzip or bzip2 that is opened is a level
+	defaultMaxArchiveSize  = 268435456 // 256MB of decompressed data for each archive on disk
+	archiveHeaderSize      = 512       // The tar magic is at offset 257
+)
+
+var errArchiveLimit = errors.New("archive size limit reached")
+
+// archiveKind identifies the archive from the first bytes of the file, the extension is not used
+func archiveKind(header []byte) int {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return archiveZip
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return archiveGzip
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return archiveBzip2
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return archiveTar
+	}
+	return archiveNone
+}
+
+// IsArchiveFile returns true when archives are scanned and the file is a zip, tar, gzip or bzip2 archive
+func IsArchiveFile(filePath string, e ExclusionsStruct) bool {
+	if e.MaxArchiveDepth <= 0 {
+		return false
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, archiveHeaderSize)
+	n, _ := io.ReadFull(file, header)
+	return archiveKind(header[:n]) != archiveNone
+}
+
+// archiveScanner scans the files of one archive on disk and keeps count of the data that was decompressed
+type archiveScanner struct {
+	m         *Matcher
+	e         ExclusionsStruct
+	out       FindingsWriter
+	remaining int64 // Decompressed bytes left before the rest of the archive is skipped, this stops zip bombs
+}
+
+// budgetReader counts the bytes read against the size limit of the archive
+// Only the output of a decompressor (gzip, bzip2 and the deflated zip entries) is counted, a reader on top of it is not
+// wrapped again so every decompressed byte is counted once
+type budgetReader struct {
+	r io.Reader
+	a *archiveScanner
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.a.remaining <= 0 {
+		return 0, errArchiveLimit
+	}
+	if int64(len(p)) > b.a.remaining {
+		p = p[:b.a.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.a.remaining -= int64(n)
+	return n, err
+}
+
+// ScanArchive scans the files in the archive, nested archives are opened until the maxArchiveDepth in the exclusions
+func ScanArchive(m *Matcher, f string, e ExclusionsStruct, out FindingsWriter) error {
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	a := &archiveScanner{m: m, e: e, out: out, remaining: int64(e.MaxArchiveSize)}
+	err = a.scan(f, file, 0)
+	if errors.Is(err, errArchiveLimit) {
+		fmt.Fprintf(statusOut, "[W] Archive larger than max archive size, skipped the rest: %s\n", f)
+		return nil
+	}
+	return err
+}
+
+// scan reads the file at location, an archive is opened and every file within is scanned with the depth increased
+func (a *archiveScanner) scan(location string, r io.Reader, depth int) error {
+	br := bufio.NewReaderSize(r, archiveHeaderSize)
+	header, _ := br.Peek(archiveHeaderSize) // A short file returns fewer bytes with io.EOF
+
+	kind := archiveKind(header)
+	if kind != archiveNone && depth >= a.e.MaxArchiveDepth {
+		fmt.Fprintf(statusOut, "[W] Archive deeper than max archive depth: %s\n", location)
+		return nil
+	}
+
+	switch kind {
+	case archiveGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return a.scan(location, &budgetReader{r: gz, a: a}, depth+1)
+	case archiveBzip2:
+		return a.scan(location, &budgetReader{r: bzip2.NewReader(br), a: a}, depth+1)
+	case archiveTar:
+		return a.scanTar(location, br, depth)
+	case archiveZip:
+		return a.scanZip(location, r, br, depth)
+	}
+	return a.scanText(location, br, header)
+}
+
+func (a *archiveScanner) scanTar(location string, r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Links, directories and devices do not have content to scan
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := a.scanEntry(location+"!"+hdr.Name, tr, depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+// scanZip opens the zip from the file on disk, a nested zip is read into memory because the directory is at the end
+// The nested zip was already counted by the decompressor it comes from, or is a file of a tar on disk
+func (a *archiveScanner) scanZip(location string, r io.Reader, br *bufio.Reader, depth int) error {
+	var zr *zip.Reader
+	if file, ok := r.(*os.File); ok {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if zr, err = zip.NewReader(file, fileInfo.Size()); err != nil {
+			return err
+		}
+	} else {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		if zr, err = zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	// Word, Excel and PowerPoint documents are zip files with a [Content_Types].xml
+	ooxml := false
+	for _, zf := range zr.File {
+		if zf.Name == "[Content_Types].xml" {
+			ooxml = true
+			break
+		}
+	}
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		inner := location + "!" + zf.Name
+		rc, err := zf.Open()
+		if err != nil {
+			fmt.Fprintf(statusOut, "[W] Failed to open %s: %v\n", inner, err)
+			continue
+		}
+		// A stored entry is not decompressed, its bytes were counted with the zip or are on disk
+		var entry io.Reader = rc
+		if zf.Method != zip.Store {
+			entry = &budgetReader{r: rc, a: a}
+		}
+		ext := strings.ToLower(path.Ext(zf.Name))
+		if ooxml && (ext == ".xml" || ext == ".rels") {
+			err = a.scanXML(inner, entry)
+		} else {
+			err = a.scanEntry(inner, entry, depth+1)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanEntry scans a file in an archive, an error in the file is a warning unless the size limit was reached
+func (a *archiveScanner) scanEntry(location string, r io.Reader, depth int) error {
+	err := a.scan(location, r, depth)
+	if err != nil && !errors.Is(err, errArchiveLimit) && err != errScanStopped {
+		fmt.Fprintf(statusOut, "[W] Failed to read %s: %v\n", location, err)
+		return nil
+	}
+	return err
+}
+
+// scanText scans a file in an archive line by line, with the same exclusions as the files on disk
+func (a *archiveScanner) scanText(location string, r io.Reader, header []byte) error {
+	for _, excludedFile := range a.e.Files {
+		if location == excludedFile {
+			fmt.Fprintf(statusOut, "[W] File is in an exclusion list: %s\n", location)
+			return nil
+		}
+	}
+	if len(header) > a.e.BinaryCheck {
+		header = header[:a.e.BinaryCheck]
+	}
+	if isBinaryData(header) {
+		fmt.Fprintf(statusOut, "[W] Binary File Detected: %s\n", location)
+		return nil
+	}
+	return ScanLines(a.m, r, location, a.out)
+}
+
+// scanXML scans the text of an OOXML part, the tags are removed so a hash between > and < is found
+// The text of a paragraph, shared string or cell is one line, the line numbers count the lines of the text
+func (a *archiveScanner) scanXML(location string, r io.Reader) error {
+	var text strings.Builder
+	lineLength := 0
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errArchiveLimit) {
+				return err
+			}
+			fmt.Fprintf(statusOut, "[W] Failed to read %s: %v\n", location, err)
+			break
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+			lineLength += len(t)
+		case xml.EndElement:
+			// Text runs (<w:t>, <a:t>, <w:r>) are parts of the same line
+			if t.Name.Local != "t" && t.Name.Local != "r" && lineLength > 0 {
+				text.WriteByte('\n')
+				lineLength = 0
+			}
+		}
+	}
+	return ScanLines(a.m, strings.NewReader(text.String()), location, a.out)
+}
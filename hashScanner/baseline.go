@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A baseline records the findings that were reviewed, a scan with -baseline only reports the findings that are not in it
+// The fingerprint is the file, a hash of the line and the match, so a finding that moves to another line is still known
+// and a finding on a line that was changed is reported again
+
+// fingerprint identifies the finding for the baseline and the SARIF partialFingerprints
+func fingerprint(f string, line string, match string) string {
+	lineHash := sha256.Sum256([]byte(line))
+	h := sha256.New()
+	h.Write([]byte(f))
+	h.Write([]byte{0})
+	h.Write(lineHash[:])
+	h.Write([]byte{0})
+	h.Write([]byte(match))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type BaselineStruct struct {
+	Updated  string                  `json:"updated"`
+	Findings []BaselineFindingStruct `json:"findings"`
+}
+
+type BaselineFindingStruct struct {
+	Fingerprint string `json:"fingerprint"`
+	File        string `json:"file"`
+	LineNumber  int    `json:"line"` // Where the finding was when it was accepted, only to help a review
+	Match       string `json:"match"`
+	Accepted    string `json:"accepted"`
+}
+
+func (b *BaselineStruct) LoadFile(f string) error {
+	baselineFile, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer baselineFile.Close()
+	decoder := json.NewDecoder(baselineFile)
+	if err := decoder.Decode(&b); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *BaselineStruct) SaveFile(f string) error {
+	sort.Slice(b.Findings, func(i, j int) bool {
+		if b.Findings[i].File != b.Findings[j].File {
+			return b.Findings[i].File < b.Findings[j].File
+		}
+		return b.Findings[i].LineNumber < b.Findings[j].LineNumber
+	})
+	b.Updated = time.Now().Format(time.RFC3339)
+
+	jsonData, err := json.MarshalIndent(b, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(f, jsonData, 0644)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// baselineWriter passes the findings that are not in the baseline to the next writer
+// With accept the new findings are added to the baseline file when the scan is finished
+type baselineWriter struct {
+	mutex      sync.Mutex
+	writer     FindingsWriter
+	file       string
+	accept     bool
+	baseline   BaselineStruct
+	known      map[string]bool
+	newFound   map[string]bool // A fingerprint is counted once even when several prototypes match the same string
+	suppressed map[string]bool
+}
+
+// NewBaselineWriter loads the baseline file, a missing file is an empty baseline so the first scan with -accept creates it
+func NewBaselineWriter(writer FindingsWriter, f string, accept bool) (FindingsWriter, error) {
+	b := &baselineWriter{writer: writer, file: f, accept: accept, known: make(map[string]bool), newFound: make(map[string]bool), suppressed: make(map[string]bool)}
+	if err := b.baseline.LoadFile(f); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not load the baseline %s: %v", f, err)
+		}
+		fmt.Fprintf(statusOut, "[W] Baseline %s does not exist, every finding is new\n", f)
+	}
+	for _, finding := range b.baseline.Findings {
+		b.known[finding.Fingerprint] = true
+	}
+	return b, nil
+}
+
+func (b *baselineWriter) Write(finding Finding) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.known[finding.Fingerprint] {
+		b.suppressed[finding.Fingerprint] = true
+		return nil
+	}
+	if !b.newFound[finding.Fingerprint] {
+		b.newFound[finding.Fingerprint] = true
+		if b.accept {
+			b.baseline.Findings = append(b.baseline.Findings, BaselineFindingStruct{
+				Fingerprint: finding.Fingerprint,
+				File:        finding.File,
+				LineNumber:  finding.LineNumber,
+				Match:       finding.Match,
+				Accepted:    time.Now().Format(time.RFC3339),
+			})
+		}
+	}
+	return b.writer.Write(finding)
+}
+
+func (b *baselineWriter) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	fmt.Fprintf(statusOut, "[*] Baseline: %d new findings, %d known findings suppressed\n", len(b.newFound), len(b.suppressed))
+	if b.accept {
+		if err := b.baseline.SaveFile(b.file); err != nil {
+			return fmt.Errorf("could not save the baseline %s: %v", b.file, err)
+		}
+		fmt.Fprintf(statusOut, "[*] Added %d findings to the baseline %s\n", len(b.newFound), b.file)
+	}
+	return b.writer.Close()
+}
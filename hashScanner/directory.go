@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// stopScan is set on Ctrl-C, the files being scanned stop at the next line and the findings so far are written
+var stopScan int32
+
+var errScanStopped = errors.New("scan stopped")
+
+func scanStopped() bool {
+	return atomic.LoadInt32(&stopScan) != 0
+}
+
+// StopOnInterrupt stops the scan on the first Ctrl-C, a second Ctrl-C exits without writing the findings
+func StopOnInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		atomic.StoreInt32(&stopScan, 1)
+	}()
+}
+
+// scanJob is a file found by the walker
+type scanJob struct {
+	path string
+	size int64
+}
+
+// ScanDirectory walks the directory while the workers scan the files that were found
+// The findings of a file are held until the file is finished and written together, so the files are not mixed in the output
+func ScanDirectory(m *Matcher, dir string, e ExclusionsStruct, out FindingsWriter, workers int, p *progress) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan scanJob, workers*4)
+
+	go func() {
+		defer close(jobs)
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if scanStopped() {
+				return errScanStopped
+			}
+			if err != nil {
+				// Keep walking, a directory that can not be read does not stop the scan
+				log.Printf("[W] Warning walking the directory: %v", err)
+				return nil
+			}
+			// Skip directories
+			if d.IsDir() {
+				return nil
+			}
+			var size int64
+			if info, err := d.Info(); err == nil {
+				size = info.Size()
+			}
+			p.found(size)
+			jobs <- scanJob{path: path, size: size}
+			return nil
+		})
+		if err != nil && err != errScanStopped {
+			log.Printf("[W] Warning walking the directory: %v", err)
+		}
+		p.walkFinished()
+	}()
+
+	var wg sync.WaitGroup
+	var outputMutex sync.Mutex
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				// Empty the channel so the walker is not blocked after Ctrl-C
+				if scanStopped() {
+					continue
+				}
+				findings := &findingsBuffer{}
+				InputFromFileChannels(m, job.path, e, findings)
+
+				// The findings of a file that was stopped by Ctrl-C are also written
+				outputMutex.Lock()
+				for _, finding := range findings.findings {
+					writeFinding(out, finding)
+				}
+				outputMutex.Unlock()
+				p.scanned(job.size)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// progress shows the files and bytes scanned with an estimate of the time left on stderr
+// The line is redrawn in place, so it is only shown when stderr is a terminal
+type progress struct {
+	mutex        sync.Mutex
+	enabled      bool
+	shown        bool // The progress line is on the screen and is cleared before other output
+	start        time.Time
+	walking      bool
+	foundFiles   int64
+	foundBytes   int64
+	scannedFiles int64
+	scannedBytes int64
+	done         chan struct{}
+}
+
+func newProgress(show bool) *progress {
+	p := &progress{start: time.Now(), walking: true, done: make(chan struct{})}
+	if info, err := os.Stderr.Stat(); show && err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		p.enabled = true
+	}
+	return p
+}
+
+func (p *progress) found(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.foundFiles++
+	p.foundBytes += size
+}
+
+func (p *progress) walkFinished() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.walking = false
+}
+
+func (p *progress) scanned(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.scannedFiles++
+	p.scannedBytes += size
+}
+
+// Start redraws the progress line twice a second until Stop is called
+func (p *progress) Start() {
+	if !p.enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.draw()
+			}
+		}
+	}()
+}
+
+// Stop removes the progress line and returns a summary of the scan
+func (p *progress) Stop() string {
+	if p.enabled {
+		close(p.done)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	return fmt.Sprintf("[*] Scanned %d of %d files (%s) in %s", p.scannedFiles, p.foundFiles, formatBytes(p.scannedBytes), time.Since(p.start).Round(time.Second))
+}
+
+func (p *progress) draw() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	elapsed := time.Since(p.start)
+	eta := "walking"
+	// The time left is only known once every file was found, it assumes the bytes left are scanned at the same rate
+	if !p.walking && p.scannedBytes > 0 {
+		left := time.Duration(float64(elapsed) * float64(p.foundBytes-p.scannedBytes) / float64(p.scannedBytes))
+		eta = left.Round(time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K[*] Scanned %d/%d files  %s/%s  %s  ETA %s",
+		p.scannedFiles, p.foundFiles, formatBytes(p.scannedBytes), formatBytes(p.foundBytes), elapsed.Round(time.Second), eta)
+	p.shown = true
+}
+
+// clear removes the progress line, the mutex is held by the caller
+func (p *progress) clear() {
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// Writer returns a writer that clears the progress line before writing, the output is not drawn over the progress line
+func (p *progress) Writer(w io.Writer) io.Writer {
+	if !p.enabled {
+		return w
+	}
+	return &progressWriter{w: w, p: p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	pw.p.mutex.Lock()
+	defer pw.p.mutex.Unlock()
+	pw.p.clear()
+	return pw.w.Write(b)
+}
+
+func formatBytes(b int64) string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(b)/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(b)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", b)
+}
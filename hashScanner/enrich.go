@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// The NTLM and SHA1 findings can be checked without a network connection against
+// the offline files saved by pwnedPasswords (offlineFiles/sha1/offline_<PREFIX>.json and offlineFiles/ntlm/offline_<PREFIX>.json)
+// and against the SHA1 and NTLM hashes of the passwords in a wordlist
+
+const (
+	hashcatSHA1 = 100
+	hashcatNTLM = 1000
+)
+
+// offlinePrefixStruct is the format of an offline file of pwnedPasswords, a hash is the prefix followed by one of the suffixes
+type offlinePrefixStruct struct {
+	Prefix string   `json:"prefix"`
+	Suffix []string `json:"suffix"`
+}
+
+// Enricher marks the findings that are known breached passwords or were cracked with the wordlist
+type Enricher struct {
+	offlineDirectory string
+	mutex            sync.Mutex
+	prefixes         map[string]map[string]bool // Loaded offline files by type and prefix, nil when there is no file for the prefix
+	cracked          map[string]string          // SHA1 and NTLM hash of each password in the wordlist
+}
+
+// NewEnricher uses the offline files in offlineDirectory and the passwords in wordlist, either can be empty
+// The wordlist is hashed when it is loaded and the hashes are kept in memory
+func NewEnricher(offlineDirectory string, wordlist string) (*Enricher, error) {
+	en := &Enricher{
+		offlineDirectory: offlineDirectory,
+		prefixes:         make(map[string]map[string]bool),
+		cracked:          make(map[string]string),
+	}
+	if len(offlineDirectory) > 0 {
+		if info, err := os.Stat(offlineDirectory); err != nil || !info.IsDir() {
+			return nil, errors.New("the offline files directory does not exist: " + offlineDirectory)
+		}
+	}
+	if len(wordlist) > 0 {
+		file, err := os.Open(wordlist)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			password := scanner.Text()
+			en.cracked["SHA1:"+SHA1Hash(password)] = password
+			en.cracked["NTLM:"+NTLMHash(password)] = password
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return en, nil
+}
+
+// SHA1Hash and NTLMHash return the upper-case hashes the same way as pwnedPasswords
+func SHA1Hash(password string) string {
+	hash := sha1.New()
+	hash.Write([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+}
+
+func NTLMHash(password string) string {
+	// MD4 of the password in UTF-16 little-endian
+	var passwordBytes []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		passwordBytes = append(passwordBytes, byte(r), byte(r>>8))
+	}
+	hash := md4.New()
+	hash.Write(passwordBytes)
+	return strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+}
+
+// candidateHash returns the hash type and the upper-case hash when a mode of the finding is NTLM or SHA1
+// A match can have a $NT$ prefix or a :salt after the hash
+func candidateHash(finding Finding) (string, string) {
+	hash := strings.TrimPrefix(finding.Match, "$NT$")
+	if i := strings.Index(hash, ":"); i >= 0 {
+		hash = hash[:i]
+	}
+	if !hexRegex.MatchString(hash) {
+		return "", ""
+	}
+	for _, m := range finding.Modes {
+		if m.Hashcat == hashcatSHA1 && len(hash) == 40 {
+			return "SHA1", strings.ToUpper(hash)
+		}
+		if m.Hashcat == hashcatNTLM && len(hash) == 32 {
+			return "NTLM", strings.ToUpper(hash)
+		}
+	}
+	return "", ""
+}
+
+// offlineSuffixes loads the offline file for the prefix once, pwnedPasswords saves the prefix in upper or lower case
+func (en *Enricher) offlineSuffixes(hashType string, prefix string) map[string]bool {
+	key := hashType + ":" + prefix
+	en.mutex.Lock()
+	defer en.mutex.Unlock()
+	if suffixes, found := en.prefixes[key]; found {
+		return suffixes
+	}
+
+	var suffixes map[string]bool
+	directory := filepath.Join(en.offlineDirectory, strings.ToLower(hashType))
+	for _, name := range []string{prefix, strings.ToLower(prefix)} {
+		offlineFile, err := os.Open(filepath.Join(directory, "offline_"+name+".json"))
+		if err != nil {
+			continue
+		}
+		var offline offlinePrefixStruct
+		err = json.NewDecoder(offlineFile).Decode(&offline)
+		offlineFile.Close()
+		if err != nil {
+			continue
+		}
+		if suffixes == nil {
+			suffixes = make(map[string]bool)
+		}
+		for _, suffix := range offline.Suffix {
+			suffixes[strings.ToUpper(suffix)] = true
+		}
+	}
+	en.prefixes[key] = suffixes
+	return suffixes
+}
+
+// Enrich marks the finding and raises the confidence when the hash is a breached password or was cracked
+func (en *Enricher) Enrich(finding *Finding) {
+	hashType, hash := candidateHash(*finding)
+	if hashType == "" {
+		return
+	}
+	finding.HashType = hashType
+
+	if len(en.offlineDirectory) > 0 && en.offlineSuffixes(hashType, hash[:5])[hash[5:]] {
+		finding.Breached = true
+		finding.Reasons = append(finding.Reasons, "known breached "+hashType)
+		finding.Confidence = 100
+	}
+	if password, found := en.cracked[hashType+":"+hash]; found {
+		finding.CrackedPassword = password
+		finding.Reasons = append(finding.Reasons, "cracked with the wordlist")
+		finding.Confidence = 100
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// The history of a local git repository is read with go-git, git does not need to be installed
+// Every commit that can be reached from a branch, tag or HEAD is compared with its parent and only the added lines are scanned,
+// so a hash that was removed from the working tree is still found in the commit that added it
+// Merge commits are skipped, the lines they bring in were added by the commits of the merged branch
+
+// commitWriter adds the commit to the findings of the files that were changed by it
+type commitWriter struct {
+	writer FindingsWriter
+	commit *object.Commit
+}
+
+func (c *commitWriter) Write(finding Finding) error {
+	finding.Commit = c.commit.Hash.String()
+	finding.Author = fmt.Sprintf("%s <%s>", c.commit.Author.Name, c.commit.Author.Email)
+	finding.Date = c.commit.Author.When.Format(time.RFC3339)
+	return c.writer.Write(finding)
+}
+
+func (c *commitWriter) Close() error { return nil }
+
+// ScanGitHistory scans the lines added by every commit of the repository, the findings have the path in the repository
+func ScanGitHistory(m *Matcher, repoPath string, e ExclusionsStruct, out FindingsWriter) error {
+	repo, err := git.PlainOpenWithOptions(repoPath, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return fmt.Errorf("could not open the git repository %s: %v", repoPath, err)
+	}
+	commits, err := repo.Log(&git.LogOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("could not read the commits of %s: %v", repoPath, err)
+	}
+	defer commits.Close()
+
+	scanned := 0
+	err = commits.ForEach(func(c *object.Commit) error {
+		if scanStopped() {
+			return errScanStopped
+		}
+		if c.NumParents() > 1 {
+			return nil
+		}
+		scanned++
+		if err := scanCommit(m, c, e, &commitWriter{writer: out, commit: c}); err != nil && err != errScanStopped {
+			fmt.Fprintf(statusOut, "[W] Failed to read commit %s: %v\n", c.Hash, err)
+		}
+		return nil
+	})
+	fmt.Fprintf(statusOut, "\n[*] Scanned %d commits of %s\n", scanned, repoPath)
+	if err == errScanStopped {
+		return nil
+	}
+	return err
+}
+
+func scanCommit(m *Matcher, c *object.Commit, e ExclusionsStruct, out FindingsWriter) error {
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	// The first commit is compared with an empty tree, every line is added
+	var parentTree *object.Tree
+	if c.NumParents() == 1 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return err
+		}
+	}
+
+	// A file that was renamed without a change has no added lines
+	changes, err := object.DiffTreeWithOptions(context.Background(), parentTree, tree, &object.DiffTreeOptions{DetectRenames: true, OnlyExactRenames: true})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		from, to, err := change.Files()
+		if err != nil {
+			fmt.Fprintf(statusOut, "[W] Failed to read %s in commit %s: %v\n", change.To.Name, c.Hash, err)
+			continue
+		}
+		// Deleted files and submodules
+		if to == nil {
+			continue
+		}
+		if err := scanBlob(m, from, to, e, out); err != nil {
+			if err == errScanStopped {
+				return err
+			}
+			fmt.Fprintf(statusOut, "[W] Failed to read %s in commit %s: %v\n", to.Name, c.Hash, err)
+		}
+	}
+	return nil
+}
+
+// scanBlob scans the lines of the file that are not in the file before the commit, archives are scanned completely
+func scanBlob(m *Matcher, from *object.File, to *object.File, e ExclusionsStruct, out FindingsWriter) error {
+	for _, excludedFile := range e.Files {
+		if to.Name == excludedFile {
+			return nil
+		}
+	}
+
+	reader, err := to.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	br := bufio.NewReaderSize(reader, archiveHeaderSize)
+	header, _ := br.Peek(archiveHeaderSize)
+
+	if e.MaxArchiveDepth > 0 && archiveKind(header) != archiveNone {
+		if to.Size > int64(e.MaxArchiveSize) {
+			return nil
+		}
+		a := &archiveScanner{m: m, e: e, out: out, remaining: int64(e.MaxArchiveSize)}
+		return a.scan(to.Name, br, 0)
+	}
+
+	if len(header) > e.BinaryCheck {
+		header = header[:e.BinaryCheck]
+	}
+	if isBinaryData(header) || to.Size > int64(e.MaxFileSize) {
+		return nil
+	}
+
+	// Count the lines of the file before the commit, a line is added when the new file has it more times
+	previous := make(map[string]int)
+	if from != nil && from.Size <= int64(e.MaxFileSize) {
+		if contents, err := from.Contents(); err == nil {
+			for _, line := range splitLines(contents) {
+				previous[line]++
+			}
+		}
+	}
+
+	contents, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	for i, line := range splitLines(string(contents)) {
+		if previous[line] > 0 {
+			previous[line]--
+			continue
+		}
+		if scanStopped() {
+			return errScanStopped
+		}
+		for _, finding := range m.ScanLine(line, to.Name) {
+			finding.LineNumber = i + 1
+			writeFinding(out, finding)
+		}
+	}
+	return nil
+}
+
+// splitLines returns the lines the same way as the files on disk are read, without the line endings
+func splitLines(contents string) []string {
+	lines := strings.Split(contents, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
@@ -9,10 +9,8 @@ import (
 	"io"
 	"log"
 	"os"
-	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
-	"sync"
 
 	cf "github.com/thepcn3rd/goAdvsCommonFunctions"
 )
@@ -50,6 +48,9 @@ type ExclusionsStruct struct {
 	MatchStrings []string `json:"matchStrings,omitempty"`
 	Regexs       []string `json:"regexs,omitempty"`
 	Files        []string `json:"files,omitempty"`
+	// Archives are opened until this depth (0 does not open archives), the decompressed data of an archive is limited to maxArchiveSize
+	MaxArchiveDepth int `json:"maxArchiveDepth"`
+	MaxArchiveSize  int `json:"maxArchiveSize"`
 }
 
 func (e *ExclusionsStruct) LoadFile(ePtr string) error {
@@ -58,6 +59,9 @@ func (e *ExclusionsStruct) LoadFile(ePtr string) error {
 		return err
 	}
 	defer exclusionsFile.Close()
+	// Exclusions files created before archives were scanned do not have the archive settings
+	e.MaxArchiveDepth = defaultMaxArchiveDepth
+	e.MaxArchiveSize = defaultMaxArchiveSize
 	decoder := json.NewDecoder(exclusionsFile)
 	if err := decoder.Decode(&e); err != nil {
 		return err
@@ -69,6 +73,8 @@ func (e *ExclusionsStruct) LoadFile(ePtr string) error {
 func (e *ExclusionsStruct) CreateFile(f string) error {
 	e.MaxFileSize = 1048576
 	e.BinaryCheck = 512
+	e.MaxArchiveDepth = defaultMaxArchiveDepth
+	e.MaxArchiveSize = defaultMaxArchiveSize
 	e.MatchStrings = append(e.MatchStrings, "string1")
 	e.MatchStrings = append(e.MatchStrings, "string2")
 	e.Regexs = append(e.Regexs, "^123$")
@@ -172,176 +178,45 @@ func (ps *PrototypesStruct) SaveNewFile(oPtr string) error {
 	return nil
 }
 
-func EvaluateRegex(pattern string, line string, p PrototypeStruct, e ExclusionsStruct, f string) {
-	colorReset := "\033[0m"
-	colorGreen := "\033[32m"
-	colorBlue := "\033[34m"
-	colorMaroon := "\033[38;5;88m"
-
-	// Compile the regular expression
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		fmt.Println(p.OriginalRegex)
-		log.Fatalln("[E] Error compiling regex:", err)
-	}
-
-	// Find the matching string with the patternValidate
-	match := re.FindString(line)
-	//if match != "" && len(match) == len(line) {
-	//fmt.Println(e)
-	// Is the match in the exclusion struct
-	// The slices module is not avaiable in golang 1.18
-	//if slices.Contains(e.MatchStrings, match) {
-	//	return
-	//}
-	for _, e := range e.MatchStrings {
-		if match == e {
-			return
-		}
-	}
-	for _, exclusionRegex := range e.Regexs {
-		reExclusion, errE := regexp.Compile(exclusionRegex)
-		if errE != nil {
-			fmt.Println(exclusionRegex)
-			log.Fatalln("[E] Error compiling regex:", err)
-		}
-		matchExclusion := reExclusion.FindString(match)
-		if matchExclusion != "" && len(matchExclusion) == len(match) {
-			return
-		}
-	}
-
-	if match != "" {
-
-		fmt.Printf("\n[*] Processing File: %s\n", f)
-		fmt.Printf("%s[$] Original string%s: %s\n", colorBlue, colorReset, line)
-		fmt.Printf("%s[$] Regex%s: %s\n", colorBlue, colorReset, p.OriginalRegex)
-		fmt.Printf("%s[$] Matched on this string%s: %s\n", colorBlue, colorReset, match)
-
-		for _, m := range p.Modes {
-			fmt.Printf("%s[+]%s %s", colorGreen, colorReset, m.HashName)
-			if m.John != "" {
-				fmt.Printf("\t%sJohn:%s %s", colorBlue, colorReset, m.John)
-			}
-			if m.Hashcat != 0 {
-				fmt.Printf("\t%sHashcat:%s %d", colorMaroon, colorReset, m.Hashcat)
-			}
-			fmt.Printf("\n")
-		}
-	}
-
-}
-
-func EvaluateFuzzyRegex(pattern string, line string, p PrototypeStruct, e ExclusionsStruct, f string) {
-	colorReset := "\033[0m"
-	colorGreen := "\033[32m"
-	colorBlue := "\033[34m"
-	colorMaroon := "\033[38;5;88m"
-	// Characters to add before and after the string that matches the patter
-	prefixRegex := "[\\s\\=\\x22\\x27\\x28\\x3c]{1}"
-	sufixRegex := "([\\s\\x22\\x27\\x29\\x3e]{1}|$)"
-	//var patternValidate string
-
-	//fmt.Printf("Adding the following prefix regex: %s\tSufix: %s\n", prefixRegex, sufixRegex)
-	patternValidate := prefixRegex + pattern + sufixRegex
-
-	// Compile the regular expression
-	reValidate, err := regexp.Compile(patternValidate)
-	if err != nil {
-		fmt.Println(p.OriginalRegex)
-		log.Fatalln("[E] Error compiling regex:", err)
-	}
-
-	var match string
-	// Find the matching string with the patternValidate
-	matchValidation := reValidate.FindString(line)
-
-	if matchValidation != "" {
-		// Compile the regular expression
-		re, err := regexp.Compile(pattern)
-		if err != nil {
-			fmt.Println(p.OriginalRegex)
-			log.Fatalln("[E] Error compiling regex:", err)
-		}
-		match = re.FindString(line)
-	}
-	//if match != "" && len(match) == len(line) {
-	// Is the match in the exclusion struct
-	//if slices.Contains(e.MatchStrings, match) {
-	//	return
-	//}
-	for _, e := range e.MatchStrings {
-		if match == e {
-			return
-		}
-	}
-	for _, exclusionRegex := range e.Regexs {
-		reExclusion, errE := regexp.Compile(exclusionRegex)
-		if errE != nil {
-			fmt.Println(exclusionRegex)
-			log.Fatalln("[E] Error compiling regex:", err)
-		}
-		matchExclusion := reExclusion.FindString(match)
-		if matchExclusion != "" && len(matchExclusion) == len(match) {
-			return
-		}
-	}
-
-	if match != "" {
-		fmt.Printf("\n[*] Processing File: %s\n", f)
-		fmt.Printf("%s[$] Original string%s: %s\n", colorBlue, colorReset, line)
-		fmt.Printf("%s[$] Regex%s: %s\n", colorBlue, colorReset, p.NewRegex)
-		fmt.Printf("%s[$] Adding the following prefix regex%s: %s\tSufix: %s\n", colorBlue, colorReset, prefixRegex, sufixRegex)
-		fmt.Printf("%s[$] Matched on this string%s: %s\n", colorBlue, colorReset, match)
-		for _, m := range p.Modes {
-			fmt.Printf("%s[+]%s %s", colorGreen, colorReset, m.HashName)
-			if m.John != "" {
-				fmt.Printf("\t%sJohn:%s %s", colorBlue, colorReset, m.John)
-			}
-			if m.Hashcat != 0 {
-				fmt.Printf("\t%sHashcat:%s %d", colorMaroon, colorReset, m.Hashcat)
-			}
-			fmt.Printf("\n")
-		}
-	}
-
-}
-
-func InputFromStdin(ps PrototypesStruct, e ExclusionsStruct, f string) {
+func InputFromStdin(m *Matcher, f string, out FindingsWriter) {
 
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Enter text to analyze below:")
+	fmt.Fprintln(statusOut, "Enter text to analyze below:")
 	line, err := reader.ReadString('\n')
 	if err != nil {
 		log.Fatalln("[E] Error reading input:", err)
 	}
-	fmt.Println()
+	fmt.Fprintln(statusOut)
 	line = strings.Replace(line, "\r", "", -1)
 	line = strings.Replace(line, "\n", "", -1)
 
 	// Evaluate the original regex
-	for _, p := range ps.Prototypes {
-		// Evaluate the Original Regex
-		EvaluateRegex(p.OriginalRegex, line, p, e, f)
-
+	for _, finding := range m.Original(line, f) {
+		finding.LineNumber = 1
+		writeFinding(out, finding)
 	}
 	// Evaluate the New Regex - This searches for the hash being present in a string with an ending delimeter of \n
 	// Evaluating for the hash in the middle of a line...  This leads to a lot of false positives...
-	//fmt.Printf("\n\n%s\n", strings.Repeat("*", 100))
-	fmt.Printf("\n[*] Evaluating the regexs to find the hash in the middle of a series of characters\n")
-	//fmt.Printf("%s\n", strings.Repeat("*", 100))
-	for _, p := range ps.Prototypes {
-		EvaluateFuzzyRegex(p.NewRegex, line, p, e, f)
+	fmt.Fprintf(statusOut, "\n[*] Evaluating the regexs to find the hash in the middle of a series of characters\n")
+	for _, finding := range m.Fuzzy(line, f) {
+		finding.LineNumber = 1
+		writeFinding(out, finding)
+	}
+}
+
+func writeFinding(out FindingsWriter, finding Finding) {
+	if err := out.Write(finding); err != nil {
+		log.Printf("[E] Failed to write the finding: %s", err)
 	}
 }
 
-func InputFromFile(ps PrototypesStruct, f string, e ExclusionsStruct) {
+func InputFromFile(m *Matcher, f string, e ExclusionsStruct, out FindingsWriter) {
 
-	fmt.Printf("\n[*] Processing File: %s\n", f)
+	fmt.Fprintf(statusOut, "\n[*] Processing File: %s\n", f)
 
 	for _, excludedFile := range e.Files {
 		if f == excludedFile {
-			fmt.Printf("[W] File is in an exclusion list: %s\n", f)
+			fmt.Fprintf(statusOut, "[W] File is in an exclusion list: %s\n", f)
 			return
 		}
 	}
@@ -351,111 +226,113 @@ func InputFromFile(ps PrototypesStruct, f string, e ExclusionsStruct) {
 	}
 	defer file.Close()
 
+	// Archives and documents are opened and the files within are scanned instead of being skipped as binary files
+	if IsArchiveFile(f, e) {
+		scanArchiveFile(m, f, e, out)
+		return
+	}
+
 	// Skip files that are binary - This function checks the first 512 bytes of the file to see if they are UTF-8 readable
 	isBinary, _ := IsBinaryFile(f, e)
 	if isBinary {
-		fmt.Printf("[W] Binary File Detected: %s\n", f)
+		fmt.Fprintf(statusOut, "[W] Binary File Detected: %s\n", f)
 		return
 	}
 
 	fileInfo, _ := os.Stat(f)
 	fileSize := fileInfo.Size()
 	if fileSize > int64(e.MaxFileSize) {
-		fmt.Printf("[W] File larger than max size: %d  Filename: %s\n", fileSize, f)
+		fmt.Fprintf(statusOut, "[W] File larger than max size: %d  Filename: %s\n", fileSize, f)
 		return
 	}
 
-	// Create a new Scanner to read the file line by line
-	scanner := bufio.NewScanner(file)
-
-	// Read each line
-	for scanner.Scan() {
-		line := scanner.Text() // Get the current line as a string
-
-		for _, p := range ps.Prototypes {
-			// Only evaluate the prototypes that are enabled - This allows customization
-			if p.Enabled {
-				// Evaluate the Original Regex
-				EvaluateRegex(p.OriginalRegex, line, p, e, f)
-			}
-		}
-		// Evaluate the New Regex - This searches for the hash being present in a string with an ending delimeter of \n
-
-		for _, p := range ps.Prototypes {
-			// Only evaluate the prototypes that are enabled - This allows customization
-			if p.Enabled {
-				EvaluateFuzzyRegex(p.NewRegex, line, p, e, f)
-			}
-		}
-	}
-
 	// Check for any errors that occurred during scanning
-	if err := scanner.Err(); err != nil {
+	if err := ScanLines(m, file, f, out); err != nil && err != errScanStopped {
 		log.Printf("[E] Error reading file: %s", err)
 	}
 }
 
-func InputFromFileChannels(ps PrototypesStruct, f string, e ExclusionsStruct, wg *sync.WaitGroup, sem chan struct{}) {
-	defer wg.Done()
-	sem <- struct{}{}
-	defer func() { <-sem }()
-
+// InputFromFileChannels scans a file for a worker of the directory scan, the messages include the file name because the workers run at the same time
+func InputFromFileChannels(m *Matcher, f string, e ExclusionsStruct, out FindingsWriter) {
 	for _, excludedFile := range e.Files {
 		if f == excludedFile {
-			fmt.Printf("\n[*] Processing File: %s\n", f)
-			fmt.Printf("[W] File is in an exclusion list: %s\n", f)
+			fmt.Fprintf(statusOut, "\n[*] Processing File: %s\n", f)
+			fmt.Fprintf(statusOut, "[W] File is in an exclusion list: %s\n", f)
 			return
 		}
 	}
 	file, err := os.Open(f)
 	if err != nil {
 		log.Printf("[E] Failed to open file: %s", err)
+		return
 	}
 	defer file.Close()
 
+	// Archives and documents are opened and the files within are scanned instead of being skipped as binary files
+	if IsArchiveFile(f, e) {
+		fmt.Fprintf(statusOut, "\n[*] Processing File: %s\n", f)
+		scanArchiveFile(m, f, e, out)
+		return
+	}
+
 	// Skip files that are binary - This function checks the first 512 bytes of the file to see if they are UTF-8 readable
 	isBinary, _ := IsBinaryFile(f, e)
 	if isBinary {
-		fmt.Printf("\n[*] Processing File: %s\n", f)
-		fmt.Printf("[W] Binary File Detected: %s\n", f)
+		fmt.Fprintf(statusOut, "\n[*] Processing File: %s\n", f)
+		fmt.Fprintf(statusOut, "[W] Binary File Detected: %s\n", f)
 		return
 	}
 
 	fileInfo, _ := os.Stat(f)
 	fileSize := fileInfo.Size()
 	if fileSize > int64(e.MaxFileSize) {
-		fmt.Printf("\n[*] Processing File: %s\n", f)
-		fmt.Printf("[W] File larger than max size: %d  Filename: %s\n", fileSize, f)
+		fmt.Fprintf(statusOut, "\n[*] Processing File: %s\n", f)
+		fmt.Fprintf(statusOut, "[W] File larger than max size: %d  Filename: %s\n", fileSize, f)
 		return
 	}
 
+	// Check for any errors that occurred during scanning
+	if err := ScanLines(m, file, f, out); err != nil && err != errScanStopped {
+		log.Printf("[E] Error reading file: %s", err)
+	}
+}
+
+// ScanLines reads r line by line and writes the findings with the location f
+func ScanLines(m *Matcher, r io.Reader, f string, out FindingsWriter) error {
 	// Create a new Scanner to read the file line by line
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(r)
 
 	// Read each line
+	lineNumber := 0
 	for scanner.Scan() {
-		line := scanner.Text() // Get the current line as a string
-
-		for _, p := range ps.Prototypes {
-			// Only evaluate the prototypes that are enabled - This allows customization
-			if p.Enabled {
-				// Evaluate the Original Regex
-				EvaluateRegex(p.OriginalRegex, line, p, e, f)
-			}
+		if scanStopped() {
+			return errScanStopped
 		}
-		// Evaluate the New Regex - This searches for the hash being present in a string with an ending delimeter of \n
+		line := scanner.Text() // Get the current line as a string
+		lineNumber++
 
-		for _, p := range ps.Prototypes {
-			// Only evaluate the prototypes that are enabled - This allows customization
-			if p.Enabled {
-				EvaluateFuzzyRegex(p.NewRegex, line, p, e, f)
-			}
+		// The original regexes are evaluated first, then the new regexes find the hash in the middle of the line
+		for _, finding := range m.ScanLine(line, f) {
+			finding.LineNumber = lineNumber
+			writeFinding(out, finding)
 		}
 	}
+	return scanner.Err()
+}
 
-	// Check for any errors that occurred during scanning
-	if err := scanner.Err(); err != nil {
-		log.Printf("[E] Error reading file: %s", err)
+// scanArchiveFile checks the size of the archive on disk, the maxFileSize is for text files and most archives are larger
+func scanArchiveFile(m *Matcher, f string, e ExclusionsStruct, out FindingsWriter) {
+	fileInfo, err := os.Stat(f)
+	if err != nil {
+		log.Printf("[E] Failed to open file: %s", err)
+		return
+	}
+	if fileInfo.Size() > int64(e.MaxArchiveSize) {
+		fmt.Fprintf(statusOut, "[W] Archive larger than max archive size: %d  Filename: %s\n", fileInfo.Size(), f)
+		return
+	}
+	if err := ScanArchive(m, f, e, out); err != nil && err != errScanStopped {
+		log.Printf("[E] Error reading archive %s: %s", f, err)
 	}
 }
 
@@ -473,23 +350,28 @@ func IsBinaryFile(filePath string, e ExclusionsStruct) (bool, error) {
 		return false, err
 	}
 
+	return isBinaryData(buffer[:n]), nil
+}
+
+// isBinaryData checks the start of a file, it is also used for the files within an archive
+func isBinaryData(buffer []byte) bool {
 	// Check for null bytes or non-printable characters
-	if bytes.Contains(buffer[:n], []byte{0}) {
-		return true, nil
+	if bytes.Contains(buffer, []byte{0}) {
+		return true
 	}
 
-	for _, b := range buffer[:n] {
+	for _, b := range buffer {
 		// New Line is DEC 10
 		// Carriage Return is DEC 13
 		// Tab is DEC 9
 		if b > 32 || b < 126 || b == 9 || b == 10 || b == 13 { // Non-printable ASCII characters
-			return false, nil
+			return false
 		} else {
-			return true, nil
+			return true
 		}
 	}
 
-	return false, nil
+	return false
 }
 
 func main() {
@@ -502,7 +384,16 @@ func main() {
 	InputPtr := flag.Bool("s", false, "Read from input to search for a match")
 	FilePtr := flag.String("f", "", "Search the specified file for hashes")
 	DirPtr := flag.String("d", "", "Search the specified directories and the files within for hashes")
+	GitPtr := flag.String("g", "", "Search the lines added by every commit of the specified git repository for hashes")
 	TemplatesPtr := flag.Bool("t", false, "Create a template prototypes.json file so I can create my own")
+	FormatPtr := flag.String("format", "console", "Output format of the findings: console, json (JSON lines), csv or sarif")
+	OutputPtr := flag.String("o", "", "Write the findings to the specified file instead of stdout")
+	ConfidencePtr := flag.Int("c", 0, "Minimum confidence (0-100) of the findings that are reported")
+	BaselinePtr := flag.String("baseline", "", "Only report the findings that are not in the specified baseline file")
+	AcceptPtr := flag.Bool("accept", false, "Add the new findings of this scan to the -baseline file")
+	OfflinePtr := flag.String("offline", "", "Check the NTLM and SHA1 findings against the offlineFiles directory of pwnedPasswords")
+	WordlistPtr := flag.String("wordlist", "", "Check the NTLM and SHA1 findings against the hashes of the passwords in the specified file")
+	WorkersPtr := flag.Int("w", runtime.NumCPU(), "Number of files scanned at the same time with -d")
 	flag.Parse()
 
 	//var creatingNew bool
@@ -561,47 +452,80 @@ func main() {
 		prototypesLoaded = true
 	}
 
-	if *InputPtr && prototypesLoaded {
-		InputFromStdin(prototypes, exclusions, "STDIN")
-	} else if prototypesLoaded && len(*FilePtr) > 0 {
-		InputFromFile(prototypes, *FilePtr, exclusions)
-	} else if prototypesLoaded && len(*DirPtr) > 0 {
-		//fmt.Println("Loaded...")
-		// Walk through the directory recursively
-		// This goes rather slow trying to improve performance with go threading...
-		var filePaths []string
-		err := filepath.Walk(*DirPtr, func(path string, info os.FileInfo, err error) error {
-
+	// Compile the prototypes and exclusions once for every file that is scanned
+	var matcher *Matcher
+	if prototypesLoaded {
+		var err error
+		matcher, err = NewMatcher(prototypes, exclusions)
+		if err != nil {
+			log.Fatalln("[E] Error compiling regex:", err)
+		}
+		matcher.MinConfidence = *ConfidencePtr
+		// Optional offline checks of the NTLM and SHA1 findings, nothing is sent over the network
+		if len(*OfflinePtr) > 0 || len(*WordlistPtr) > 0 {
+			matcher.Enricher, err = NewEnricher(*OfflinePtr, *WordlistPtr)
 			if err != nil {
-				return fmt.Errorf("[E] error accessing path %q: %w", path, err)
+				log.Fatalln("[E] Error loading the offline checks:", err)
 			}
+		}
+	}
 
-			// Skip directories
-			if info.IsDir() {
-				return nil
-			}
-
-			// Gather the filepaths of the files to parse
-			filePaths = append(filePaths, path)
-
-			return nil
-		})
-
-		// Handle any errors from filepath.Walk
+	// The findings go to stdout or the output file, with a machine readable format on stdout the messages go to stderr
+	var findingsOut io.Writer = os.Stdout
+	statusOut = os.Stdout
+	if len(*OutputPtr) > 0 {
+		outputFile, err := os.Create(*OutputPtr)
 		if err != nil {
-			log.Printf("[W] Warning walking the directory: %v", err)
+			log.Fatalf("[E] Could not create the output file %s: %v\n", *OutputPtr, err)
 		}
-
-		//lengthFilePaths := len(filePaths)
-		var wg sync.WaitGroup
-		// Process 10 files at a time...
-		semaphore := make(chan struct{}, 10)
-		for _, path := range filePaths {
-			wg.Add(1)
-			InputFromFileChannels(prototypes, path, exclusions, &wg, semaphore)
+		defer outputFile.Close()
+		findingsOut = outputFile
+	} else if strings.ToLower(*FormatPtr) != formatConsole {
+		statusOut = os.Stderr
+	}
+	// The progress of a directory scan is shown on stderr, the other output clears the progress line before it is written
+	scanProgress := newProgress(len(*DirPtr) > 0)
+	statusOut = scanProgress.Writer(statusOut)
+	findingsOut = scanProgress.Writer(findingsOut)
+	log.SetOutput(scanProgress.Writer(os.Stderr))
+	out, err := NewFindingsWriter(*FormatPtr, findingsOut)
+	if err != nil {
+		log.Fatalf("[E] %v\n", err)
+	}
+	// Only the findings that are not in the baseline are written, -accept adds them to the baseline
+	if len(*BaselinePtr) > 0 {
+		out, err = NewBaselineWriter(out, *BaselinePtr, *AcceptPtr)
+		if err != nil {
+			log.Fatalf("[E] %v\n", err)
 		}
+	} else if *AcceptPtr {
+		log.Fatalln("[E] -accept needs the baseline file with -baseline")
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			log.Printf("[E] Failed to write the findings: %v", err)
+		}
+	}()
 
-		wg.Wait()
+	if *InputPtr && prototypesLoaded {
+		InputFromStdin(matcher, "STDIN", out)
+	} else if prototypesLoaded && len(*FilePtr) > 0 {
+		StopOnInterrupt()
+		InputFromFile(matcher, *FilePtr, exclusions, out)
+	} else if prototypesLoaded && len(*GitPtr) > 0 {
+		StopOnInterrupt()
+		if err := ScanGitHistory(matcher, *GitPtr, exclusions, out); err != nil {
+			log.Printf("[E] %v", err)
+		}
+	} else if prototypesLoaded && len(*DirPtr) > 0 {
+		// The files are scanned while the directory is walked, Ctrl-C stops the scan and the findings so far are written
+		StopOnInterrupt()
+		scanProgress.Start()
+		ScanDirectory(matcher, *DirPtr, exclusions, out, *WorkersPtr, scanProgress)
+		fmt.Fprintf(statusOut, "\n%s\n", scanProgress.Stop())
+		if scanStopped() {
+			fmt.Fprintf(statusOut, "[W] Scan stopped with Ctrl-C, the findings of the files scanned so far were written\n")
+		}
 	}
 
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Characters to add before and after the string that matches the pattern
+const (
+	prefixRegex = "[\\s\\=\\x22\\x27\\x28\\x3c]{1}"
+	sufixRegex  = "([\\s\\x22\\x27\\x29\\x3e]{1}|$)"
+)
+
+const maxClasses = 64 // One bit for each character class in classMasks
+
+// runCondition is a run of at least length characters from a character class that every match contains
+type runCondition struct {
+	class  int
+	length int
+}
+
+// prefilter holds what every match of a regex contains, a line without it is not checked with the regex
+type prefilter struct {
+	runs     []runCondition
+	literals []string
+}
+
+// compiledPrototype holds the regexes of a prototype compiled once before the scan starts
+type compiledPrototype struct {
+	prototype      PrototypeStruct
+	rule           string         // Identifies the prototype in the findings, the position of the prototype in the prototypes file
+	original       *regexp.Regexp // The hash is the whole line
+	validate       *regexp.Regexp // The hash is in a line between the prefix and sufix characters
+	fuzzy          *regexp.Regexp // Finds the hash in the line once validate matched
+	originalFilter prefilter
+	fuzzyFilter    prefilter
+}
+
+// Matcher compiles the enabled prototypes and the exclusions once and is shared by every file that is scanned
+// Most hashes are a long run of one character class (e.g. [a-f0-9]{32}) or start with a literal (e.g. $6$),
+// so every line is read once to find the longest run of each class and only the prototypes the line can match are evaluated
+type Matcher struct {
+	prototypes      []compiledPrototype
+	classes         []string    // Character classes used by the run conditions
+	classMasks      [256]uint64 // Bit i is set when the byte is in classes[i]
+	excludedStrings map[string]bool
+	excludedRegexs  []*regexp.Regexp
+	MinConfidence   int       // Findings with a lower confidence are not returned
+	Enricher        *Enricher // Checks the NTLM and SHA1 findings before the confidence is compared, can be nil
+}
+
+func NewMatcher(ps PrototypesStruct, e ExclusionsStruct) (*Matcher, error) {
+	m := &Matcher{excludedStrings: make(map[string]bool)}
+
+	for i, p := range ps.Prototypes {
+		// Only evaluate the prototypes that are enabled - This allows customization
+		if !p.Enabled {
+			continue
+		}
+		original, err := regexp.Compile(p.OriginalRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regex %s: %v", p.OriginalRegex, err)
+		}
+		validate, err := regexp.Compile(prefixRegex + p.NewRegex + sufixRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regex %s: %v", p.NewRegex, err)
+		}
+		fuzzy, err := regexp.Compile(p.NewRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regex %s: %v", p.NewRegex, err)
+		}
+		m.prototypes = append(m.prototypes, compiledPrototype{
+			prototype:      p,
+			rule:           fmt.Sprintf("HASH%03d", i+1),
+			original:       original,
+			validate:       validate,
+			fuzzy:          fuzzy,
+			originalFilter: m.newPrefilter(p.OriginalRegex),
+			fuzzyFilter:    m.newPrefilter(p.NewRegex),
+		})
+	}
+
+	for _, s := range e.MatchStrings {
+		m.excludedStrings[s] = true
+	}
+	for _, exclusionRegex := range e.Regexs {
+		re, err := regexp.Compile(exclusionRegex)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling exclusion regex %s: %v", exclusionRegex, err)
+		}
+		m.excludedRegexs = append(m.excludedRegexs, re)
+	}
+	return m, nil
+}
+
+// newPrefilter finds the runs of a character class and the literals that every match of the pattern contains
+// Only the parts of a concatenation are required, anything inside an alternation or an optional group is ignored
+func (m *Matcher) newPrefilter(pattern string) prefilter {
+	var filter prefilter
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return filter
+	}
+
+	var walk func(re *syntax.Regexp)
+	walk = func(re *syntax.Regexp) {
+		switch re.Op {
+		case syntax.OpConcat, syntax.OpCapture:
+			for _, sub := range re.Sub {
+				walk(sub)
+			}
+		case syntax.OpRepeat:
+			if re.Min >= 2 && (re.Sub[0].Op == syntax.OpCharClass || re.Sub[0].Op == syntax.OpLiteral) {
+				if class := m.classIndex(re.Sub[0]); class >= 0 {
+					filter.runs = append(filter.runs, runCondition{class: class, length: re.Min})
+				}
+			}
+		case syntax.OpLiteral:
+			if re.Flags&syntax.FoldCase == 0 {
+				filter.literals = append(filter.literals, string(re.Rune))
+			}
+		}
+	}
+	walk(re)
+	return filter
+}
+
+// classIndex returns the index of the character class, the class is added when it is new
+// -1 is returned when there is no bit left for the class, the run is then not used to skip lines
+func (m *Matcher) classIndex(re *syntax.Regexp) int {
+	key := re.String()
+	for i, class := range m.classes {
+		if class == key {
+			return i
+		}
+	}
+	if len(m.classes) == maxClasses {
+		return -1
+	}
+
+	index := len(m.classes)
+	m.classes = append(m.classes, key)
+	ranges := re.Rune // Pairs of low and high runes for a class
+	if re.Op == syntax.OpLiteral {
+		// The rune of a case-folded literal is the minimum fold (e.g. X for (?i)x), every fold of it is in the class
+		ranges = nil
+		for _, r := range re.Rune {
+			ranges = append(ranges, r, r)
+			if re.Flags&syntax.FoldCase != 0 {
+				for fold := unicode.SimpleFold(r); fold != r; fold = unicode.SimpleFold(fold) {
+					ranges = append(ranges, fold, fold)
+				}
+			}
+		}
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for r := ranges[i]; r <= ranges[i+1]; r++ {
+			if r >= utf8.RuneSelf {
+				// Every byte of a multi-byte character is counted, so the run in bytes is never shorter than the run in characters
+				for b := utf8.RuneSelf; b < 256; b++ {
+					m.classMasks[b] |= 1 << index
+				}
+				break
+			}
+			m.classMasks[r] |= 1 << index
+		}
+	}
+	return index
+}
+
+// longestRuns reads the line once and returns the longest run of each character class
+func (m *Matcher) longestRuns(line string) [maxClasses]int {
+	var longest, current [maxClasses]int
+	classCount := len(m.classes)
+	for i := 0; i < len(line); i++ {
+		mask := m.classMasks[line[i]]
+		for c := 0; c < classCount; c++ {
+			if mask&(1<<c) != 0 {
+				current[c]++
+				if current[c] > longest[c] {
+					longest[c] = current[c]
+				}
+			} else {
+				current[c] = 0
+			}
+		}
+	}
+	return longest
+}
+
+// possible returns false when the line does not have a run or a literal that every match needs
+func (f prefilter) possible(line string, runs *[maxClasses]int) bool {
+	for _, run := range f.runs {
+		if runs[run.class] < run.length {
+			return false
+		}
+	}
+	for _, literal := range f.literals {
+		if !strings.Contains(line, literal) {
+			return false
+		}
+	}
+	return true
+}
+
+// excluded returns true when the match is in the matchStrings or an exclusion regex matches all of it
+func (m *Matcher) excluded(match string) bool {
+	if m.excludedStrings[match] {
+		return true
+	}
+	for _, re := range m.excludedRegexs {
+		matchExclusion := re.FindString(match)
+		if matchExclusion != "" && len(matchExclusion) == len(match) {
+			return true
+		}
+	}
+	return false
+}
+
+// Original returns the prototypes where the original regex matches the line
+func (m *Matcher) Original(line string, f string) []Finding {
+	runs := m.longestRuns(line)
+	return m.original(line, f, &runs)
+}
+
+func (m *Matcher) original(line string, f string, runs *[maxClasses]int) []Finding {
+	var findings []Finding
+	for _, cp := range m.prototypes {
+		if !cp.originalFilter.possible(line, runs) {
+			continue
+		}
+		loc := cp.original.FindStringIndex(line)
+		if loc == nil || loc[0] == loc[1] {
+			continue
+		}
+		if m.excluded(line[loc[0]:loc[1]]) {
+			continue
+		}
+		finding := newFinding(cp, f, line, loc, false)
+		if m.Enricher != nil {
+			m.Enricher.Enrich(&finding)
+		}
+		if finding.Confidence < m.MinConfidence {
+			continue
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+// Fuzzy returns the prototypes where the newRegex is found in the middle of the line between the prefix and sufix characters
+func (m *Matcher) Fuzzy(line string, f string) []Finding {
+	runs := m.longestRuns(line)
+	return m.fuzzy(line, f, &runs)
+}
+
+func (m *Matcher) fuzzy(line string, f string, runs *[maxClasses]int) []Finding {
+	var findings []Finding
+	for _, cp := range m.prototypes {
+		if !cp.fuzzyFilter.possible(line, runs) || !cp.validate.MatchString(line) {
+			continue
+		}
+		loc := cp.fuzzy.FindStringIndex(line)
+		if loc == nil || loc[0] == loc[1] {
+			continue
+		}
+		if m.excluded(line[loc[0]:loc[1]]) {
+			continue
+		}
+		finding := newFinding(cp, f, line, loc, true)
+		if m.Enricher != nil {
+			m.Enricher.Enrich(&finding)
+		}
+		if finding.Confidence < m.MinConfidence {
+			continue
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+// ScanLine returns the original matches followed by the fuzzy matches for the line, the line is only read once for both
+func (m *Matcher) ScanLine(line string, f string) []Finding {
+	runs := m.longestRuns(line)
+	return append(m.original(line, f, &runs), m.fuzzy(line, f, &runs)...)
+}
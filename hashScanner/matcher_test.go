@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Run the benchmarks with: go test -bench . -benchmem
+// Set HASHSCANNER_BENCH_DIR to a directory to measure the throughput on a real tree, e.g. a multi-GB source checkout
+
+func loadBenchmarkFiles(b *testing.B) (PrototypesStruct, ExclusionsStruct) {
+	var ps PrototypesStruct
+	if err := ps.LoadFile("customPrototypes.json"); err != nil {
+		b.Fatalf("Could not load customPrototypes.json: %v", err)
+	}
+	var e ExclusionsStruct
+	if err := e.LoadFile("exclusions.json"); err != nil {
+		b.Fatalf("Could not load exclusions.json: %v", err)
+	}
+	return ps, e
+}
+
+// benchmarkLines returns source code and log like lines with a hash in about 1 of 50 lines
+func benchmarkLines(count int) []string {
+	r := rand.New(rand.NewSource(1))
+	hex := func(n int) string {
+		const chars = "0123456789abcdef"
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			sb.WriteByte(chars[r.Intn(len(chars))])
+		}
+		return sb.String()
+	}
+	templates := []string{
+		"func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {",
+		"\tif err != nil { return fmt.Errorf(\"unable to open %s: %v\", name, err) }",
+		"2024-01-02 15:04:05 INFO request completed status=200 duration=12ms path=/api/v1/users",
+		"<div class=\"container\"><a href=\"/index.html\">Home</a></div>",
+		"# Configuration values for the production environment",
+		"    \"name\": \"example\", \"version\": \"1.2.3\", \"private\": true,",
+	}
+	var lines []string
+	for i := 0; i < count; i++ {
+		switch {
+		case i%50 == 0:
+			lines = append(lines, fmt.Sprintf("password_hash = \"%s\"", hex(32)))
+		case i%97 == 0:
+			lines = append(lines, hex(64))
+		default:
+			lines = append(lines, templates[r.Intn(len(templates))])
+		}
+	}
+	return lines
+}
+
+// evaluatePerLine is the scan from before the Matcher, every regex is compiled for every line
+func evaluatePerLine(ps PrototypesStruct, e ExclusionsStruct, line string) int {
+	found := 0
+	excluded := func(match string) bool {
+		for _, s := range e.MatchStrings {
+			if match == s {
+				return true
+			}
+		}
+		for _, exclusionRegex := range e.Regexs {
+			re := regexp.MustCompile(exclusionRegex)
+			matchExclusion := re.FindString(match)
+			if matchExclusion != "" && len(matchExclusion) == len(match) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range ps.Prototypes {
+		if !p.Enabled {
+			continue
+		}
+		match := regexp.MustCompile(p.OriginalRegex).FindString(line)
+		if !excluded(match) && match != "" {
+			found++
+		}
+	}
+	for _, p := range ps.Prototypes {
+		if !p.Enabled {
+			continue
+		}
+		var match string
+		if regexp.MustCompile(prefixRegex+p.NewRegex+sufixRegex).FindString(line) != "" {
+			match = regexp.MustCompile(p.NewRegex).FindString(line)
+		}
+		if !excluded(match) && match != "" {
+			found++
+		}
+	}
+	return found
+}
+
+func linesSize(lines []string) int64 {
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	return size
+}
+
+func BenchmarkCompilePerLine(b *testing.B) {
+	ps, e := loadBenchmarkFiles(b)
+	lines := benchmarkLines(200)
+	b.SetBytes(linesSize(lines))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			evaluatePerLine(ps, e, line)
+		}
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	ps, e := loadBenchmarkFiles(b)
+	m, err := NewMatcher(ps, e)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := benchmarkLines(200)
+	b.SetBytes(linesSize(lines))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			m.ScanLine(line, "benchmark")
+		}
+	}
+}
+
+// BenchmarkMatcherTree scans every text file in HASHSCANNER_BENCH_DIR, the MB/s column is the throughput of the scan
+func BenchmarkMatcherTree(b *testing.B) {
+	dir := os.Getenv("HASHSCANNER_BENCH_DIR")
+	if dir == "" {
+		b.Skip("HASHSCANNER_BENCH_DIR is not set")
+	}
+	ps, e := loadBenchmarkFiles(b)
+	m, err := NewMatcher(ps, e)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var files []string
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if isBinary, _ := IsBinaryFile(path, e); isBinary {
+			return nil
+		}
+		files = append(files, path)
+		size += info.Size()
+		return nil
+	})
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, path := range files {
+			file, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				m.ScanLine(scanner.Text(), path)
+			}
+			file.Close()
+		}
+	}
+}
+
+// expectedFindings is the scan without the prefilter, the regexes of every prototype are evaluated for the line
+func expectedFindings(m *Matcher, line string) []string {
+	var found []string
+	for _, cp := range m.prototypes {
+		if loc := cp.original.FindStringIndex(line); loc != nil && loc[0] != loc[1] && !m.excluded(line[loc[0]:loc[1]]) {
+			found = append(found, cp.rule)
+		}
+	}
+	for _, cp := range m.prototypes {
+		if !cp.validate.MatchString(line) {
+			continue
+		}
+		if loc := cp.fuzzy.FindStringIndex(line); loc != nil && loc[0] != loc[1] && !m.excluded(line[loc[0]:loc[1]]) {
+			found = append(found, cp.rule+" fuzzy")
+		}
+	}
+	return found
+}
+
+// TestScanLineMatchesRegexp checks that the prefilter never skips a line one of the regexes matches
+func TestScanLineMatchesRegexp(t *testing.T) {
+	var ps PrototypesStruct
+	if err := ps.LoadFile("customPrototypes.json"); err != nil {
+		t.Fatalf("Could not load customPrototypes.json: %v", err)
+	}
+	var e ExclusionsStruct
+	if err := e.LoadFile("exclusions.json"); err != nil {
+		t.Fatalf("Could not load exclusions.json: %v", err)
+	}
+	for i := range ps.Prototypes {
+		ps.Prototypes[i].Enabled = true
+	}
+	for _, pattern := range []string{"(?i)x{4}[0-9a-f]{8}", "(?i)[0-9a-f]{32}", "(?i)(?:ab){3}[0-9]{6}", "(?i)\\$k{2}\\$[a-z0-9]{10}"} {
+		ps.Prototypes = append(ps.Prototypes, PrototypeStruct{OriginalRegex: "^" + pattern + "$", NewRegex: pattern, Enabled: true})
+	}
+	m, err := NewMatcher(ps, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := benchmarkLines(500)
+	for _, match := range []string{"XXXX0123abcd", "xxxx0123abcd", "xXxX0123ABCD", "0123456789ABCDEF0123456789abcdef", "abABab123456", "$kK$abc123XYZ0",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", "$6$rounds=5000$saltsalt$abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJ", "8846F7EAEE8FB117AD06BDD830B7586C"} {
+		lines = append(lines, match, "hash = \""+match+"\"", "("+match+")")
+	}
+
+	for _, line := range lines {
+		var found []string
+		for _, finding := range m.ScanLine(line, "test") {
+			if finding.Fuzzy {
+				found = append(found, finding.Rule+" fuzzy")
+			} else {
+				found = append(found, finding.Rule)
+			}
+		}
+		expected := expectedFindings(m, line)
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: ScanLine found %v, the regexes match %v", line, found, expected)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// References: https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html (SARIF format)
+
+// Output formats selected with the -format flag
+const (
+	formatConsole = "console"
+	formatJSON    = "json"
+	formatCSV     = "csv"
+	formatSARIF   = "sarif"
+)
+
+// statusOut receives the processing and warning messages, it is stderr when the findings are written to stdout in a machine readable format
+var statusOut io.Writer
+
+// Finding is a string that matched a prototype
+type Finding struct {
+	File            string       `json:"file"`
+	LineNumber      int          `json:"line"`
+	Column          int          `json:"column"` // Character position of the match in the line, starting at 1
+	Match           string       `json:"match"`
+	Rule            string       `json:"rule"`
+	Regex           string       `json:"regex"`
+	Notes           string       `json:"notes,omitempty"`
+	Fuzzy           bool         `json:"fuzzy"` // Matched the newRegex in the middle of the line instead of the original regex
+	Modes           []ModeStruct `json:"modes"`
+	Confidence      int          `json:"confidence"` // 0 to 100, see scoreFinding
+	Reasons         []string     `json:"reasons,omitempty"`
+	Fingerprint     string       `json:"fingerprint"`      // Identifies the finding in a baseline, see fingerprint
+	Commit          string       `json:"commit,omitempty"` // The commit that added the line when the git history is scanned
+	Author          string       `json:"author,omitempty"`
+	Date            string       `json:"date,omitempty"`
+	HashType        string       `json:"hashType,omitempty"` // SHA1 or NTLM when the finding was checked by the Enricher
+	Breached        bool         `json:"breached,omitempty"`
+	CrackedPassword string       `json:"crackedPassword,omitempty"`
+	Line            string       `json:"-"` // Only shown in the console, the line can contain more secrets than the match
+}
+
+func newFinding(cp compiledPrototype, f string, line string, loc []int, fuzzy bool) Finding {
+	regex := cp.prototype.OriginalRegex
+	if fuzzy {
+		regex = cp.prototype.NewRegex
+	}
+	confidence, reasons := scoreFinding(f, line, loc)
+	return Finding{
+		File:   f,
+		Column: utf8.RuneCountInString(line[:loc[0]]) + 1,
+		Match:  line[loc[0]:loc[1]],
+		Rule:   cp.rule,
+		Regex:  regex,
+		Notes:  cp.prototype.Notes,
+		Fuzzy:  fuzzy,
+		Modes:  cp.prototype.Modes,
+		Line:   line,
+
+		Confidence:  confidence,
+		Reasons:     reasons,
+		Fingerprint: fingerprint(f, line, line[loc[0]:loc[1]]),
+	}
+}
+
+// FindingsWriter renders the findings, Close writes anything that was held back until the scan finished
+type FindingsWriter interface {
+	Write(finding Finding) error
+	Close() error
+}
+
+// NewFindingsWriter returns the writer for the format, the writer can be used by more than one goroutine
+func NewFindingsWriter(format string, w io.Writer) (FindingsWriter, error) {
+	var writer FindingsWriter
+	switch strings.ToLower(format) {
+	case formatConsole, "":
+		writer = &consoleWriter{w: w}
+	case formatJSON, "jsonl":
+		writer = &jsonWriter{encoder: json.NewEncoder(w)}
+	case formatCSV:
+		writer = &csvWriter{w: csv.NewWriter(w)}
+	case formatSARIF:
+		writer = &sarifWriter{w: w}
+	default:
+		return nil, fmt.Errorf("unknown output format %s, use console, json, csv or sarif", format)
+	}
+	return &lockedWriter{writer: writer}, nil
+}
+
+// lockedWriter keeps the findings from different files from being mixed together
+type lockedWriter struct {
+	mutex  sync.Mutex
+	writer FindingsWriter
+}
+
+func (l *lockedWriter) Write(finding Finding) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.writer.Write(finding)
+}
+
+func (l *lockedWriter) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.writer.Close()
+}
+
+// findingsBuffer holds the findings of one file until the file has been scanned
+type findingsBuffer struct {
+	findings []Finding
+}
+
+func (b *findingsBuffer) Write(finding Finding) error {
+	b.findings = append(b.findings, finding)
+	return nil
+}
+
+func (b *findingsBuffer) Close() error { return nil }
+
+// consoleWriter is the coloured view
+type consoleWriter struct {
+	w io.Writer
+}
+
+func (c *consoleWriter) Write(finding Finding) error {
+	colorReset := "\033[0m"
+	colorGreen := "\033[32m"
+	colorBlue := "\033[34m"
+	colorMaroon := "\033[38;5;88m"
+
+	fmt.Fprintf(c.w, "\n[*] Processing File: %s\n", finding.File)
+	if finding.Commit != "" {
+		fmt.Fprintf(c.w, "%s[$] Commit%s: %s  %sAuthor%s: %s  %sDate%s: %s\n", colorBlue, colorReset, finding.Commit, colorBlue, colorReset, finding.Author, colorBlue, colorReset, finding.Date)
+	}
+	fmt.Fprintf(c.w, "%s[$] Original string%s: %s\n", colorBlue, colorReset, finding.Line)
+	fmt.Fprintf(c.w, "%s[$] Regex%s: %s\n", colorBlue, colorReset, finding.Regex)
+	if finding.Fuzzy {
+		fmt.Fprintf(c.w, "%s[$] Adding the following prefix regex%s: %s\tSufix: %s\n", colorBlue, colorReset, prefixRegex, sufixRegex)
+	}
+	fmt.Fprintf(c.w, "%s[$] Matched on this string%s: %s\n", colorBlue, colorReset, finding.Match)
+	fmt.Fprintf(c.w, "%s[$] Confidence%s: %d", colorBlue, colorReset, finding.Confidence)
+	if len(finding.Reasons) > 0 {
+		fmt.Fprintf(c.w, " (%s)", strings.Join(finding.Reasons, ", "))
+	}
+	fmt.Fprintf(c.w, "\n")
+	if finding.Breached {
+		fmt.Fprintf(c.w, "%s[!] Known breached %s password hash in the offline files%s\n", colorMaroon, finding.HashType, colorReset)
+	}
+	if finding.CrackedPassword != "" {
+		fmt.Fprintf(c.w, "%s[!] Cracked %s hash with the wordlist%s: %s\n", colorMaroon, finding.HashType, colorReset, finding.CrackedPassword)
+	}
+	for _, m := range finding.Modes {
+		fmt.Fprintf(c.w, "%s[+]%s %s", colorGreen, colorReset, m.HashName)
+		if m.John != "" {
+			fmt.Fprintf(c.w, "\t%sJohn:%s %s", colorBlue, colorReset, m.John)
+		}
+		if m.Hashcat != 0 {
+			fmt.Fprintf(c.w, "\t%sHashcat:%s %d", colorMaroon, colorReset, m.Hashcat)
+		}
+		fmt.Fprintf(c.w, "\n")
+	}
+	return nil
+}
+
+func (c *consoleWriter) Close() error { return nil }
+
+// jsonWriter writes one JSON object per line
+type jsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonWriter) Write(finding Finding) error {
+	return j.encoder.Encode(finding)
+}
+
+func (j *jsonWriter) Close() error { return nil }
+
+// csvWriter writes one row per finding, the hash modes are joined with ;
+type csvWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (c *csvWriter) Write(finding Finding) error {
+	if !c.headerWritten {
+		c.headerWritten = true
+		c.w.Write([]string{"file", "line", "column", "match", "rule", "regex", "fuzzy", "names", "john", "hashcat", "confidence", "commit", "author", "date", "breached", "crackedPassword"})
+	}
+	// The names, john and hashcat columns have one entry for each mode in the same order, a mode without a format is empty
+	var names, john, hashcat []string
+	for _, m := range finding.Modes {
+		names = append(names, m.HashName)
+		john = append(john, m.John)
+		if m.Hashcat != 0 {
+			hashcat = append(hashcat, strconv.Itoa(m.Hashcat))
+		} else {
+			hashcat = append(hashcat, "")
+		}
+	}
+	err := c.w.Write([]string{
+		finding.File,
+		strconv.Itoa(finding.LineNumber),
+		strconv.Itoa(finding.Column),
+		finding.Match,
+		finding.Rule,
+		finding.Regex,
+		strconv.FormatBool(finding.Fuzzy),
+		strings.Join(names, ";"),
+		strings.Join(john, ";"),
+		strings.Join(hashcat, ";"),
+		strconv.Itoa(finding.Confidence),
+		finding.Commit,
+		finding.Author,
+		finding.Date,
+		strconv.FormatBool(finding.Breached),
+		finding.CrackedPassword,
+	})
+	if err != nil {
+		return err
+	}
+	// Flush every row so the file can be followed while a long scan runs
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// SARIF log, only the fields used by the scanner
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	ShortDescription sarifMessage      `json:"shortDescription"`
+	Properties       map[string]string `json:"properties,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Rank      float64         `json:"rank"` // The confidence of the finding
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+	// Code scanning uses the fingerprint to match the results of the next scan
+	PartialFingerprints map[string]string      `json:"partialFingerprints"`
+	Properties          map[string]interface{} `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// sarifWriter keeps the findings until the scan has finished, a SARIF file is a single JSON document
+type sarifWriter struct {
+	w        io.Writer
+	findings []Finding
+}
+
+func (s *sarifWriter) Write(finding Finding) error {
+	s.findings = append(s.findings, finding)
+	return nil
+}
+
+// sarifProperties has the details of the finding that are not in the SARIF result
+func sarifProperties(finding Finding) map[string]interface{} {
+	properties := map[string]interface{}{"match": finding.Match, "fuzzy": finding.Fuzzy, "modes": finding.Modes, "reasons": finding.Reasons}
+	if finding.HashType != "" {
+		properties["hashType"] = finding.HashType
+		properties["breached"] = finding.Breached
+		properties["cracked"] = finding.CrackedPassword != ""
+	}
+	if finding.Commit != "" {
+		properties["commit"] = finding.Commit
+		properties["author"] = finding.Author
+		properties["date"] = finding.Date
+	}
+	return properties
+}
+
+// sarifLevel shows the breached and cracked hashes as errors, the likely hashes as warnings and the rest as notes
+func sarifLevel(finding Finding) string {
+	if finding.Breached || finding.CrackedPassword != "" {
+		return "error"
+	}
+	if finding.Confidence >= baseConfidence {
+		return "warning"
+	}
+	return "note"
+}
+
+func hashNames(modes []ModeStruct) string {
+	var names []string
+	for _, m := range modes {
+		names = append(names, m.HashName)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (s *sarifWriter) Close() error {
+	run := sarifRun{
+		Tool:       sarifTool{Driver: sarifDriver{Name: "hashScanner"}},
+		ColumnKind: "unicodeCodePoints",
+		Results:    []sarifResult{},
+	}
+
+	ruleIndex := make(map[string]int)
+	for _, finding := range s.findings {
+		index, found := ruleIndex[finding.Rule]
+		if !found {
+			index = len(run.Tool.Driver.Rules)
+			ruleIndex[finding.Rule] = index
+			name := finding.Rule
+			if len(finding.Modes) > 0 {
+				name = finding.Modes[0].HashName
+			}
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+				ID:               finding.Rule,
+				Name:             name,
+				ShortDescription: sarifMessage{Text: "Possible " + hashNames(finding.Modes)},
+				Properties:       map[string]string{"regex": finding.Regex, "notes": finding.Notes},
+			})
+		}
+
+		run.Results = append(run.Results, sarifResult{
+			RuleID:              finding.Rule,
+			RuleIndex:           index,
+			Level:               sarifLevel(finding),
+			Rank:                float64(finding.Confidence),
+			PartialFingerprints: map[string]string{"hashScanner/v1": finding.Fingerprint},
+			Message:             sarifMessage{Text: fmt.Sprintf("Possible %s: %s", hashNames(finding.Modes), finding.Match)},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(finding.File)},
+				Region: sarifRegion{
+					StartLine:   finding.LineNumber,
+					StartColumn: finding.Column,
+					EndColumn:   finding.Column + utf8.RuneCountInString(finding.Match),
+				},
+			}}},
+			Properties: sarifProperties(finding),
+		})
+	}
+
+	encoder := json.NewEncoder(s.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
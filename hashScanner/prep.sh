@@ -11,8 +11,10 @@ go env -w GO111MODULE='auto'
 
 # Install Dependencies
 go get github.com/thepcn3rd/goAdvsCommonFunctions
+go get github.com/go-git/go-git/v5
+go get golang.org/x/crypto/md4
 
 
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" main.go 
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" . 
 #GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" main.go
 
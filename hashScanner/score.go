@@ -0,0 +1,174 @@
+package main
+
+import (
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The confidence of a finding starts at 50 and is raised or lowered by what is known about the match, the line and the file
+// Patterns like [a-f0-9]{32} also match UUIDs, git object IDs and random IDs, the score puts those below the real hashes
+// The reasons of a score are added to the finding so a threshold can be tuned
+
+const baseConfidence = 50
+
+// Words near a match that is a password hash or a secret
+var hashKeywords = []string{"password", "passwd", "pwd", "hash", "secret", "shadow", "ntlm", "md5", "sha1", "sha256", "sha512", "bcrypt", "crypt", "salt", "credential", "htpasswd", "digest"}
+
+// Words near a match that is an ID of a commit or a file in version control
+var gitKeywords = []string{"commit", "tree", "parent", "merge", "revision", "git", "checkout", "blob", "refs/"}
+
+// Files where hashes are expected, and files where they are checksums of packages or generated content
+var (
+	hashFiles      = []string{"shadow", "passwd", "htpasswd", ".htpasswd", "hashes", "hashes.txt", "ntds.dit", "sam"}
+	hashExtensions = []string{".hash", ".hashes", ".pot", ".potfile", ".sql", ".env", ".conf", ".cfg", ".ini", ".yml", ".yaml", ".properties"}
+	checksumFiles  = []string{"package-lock.json", "yarn.lock", "pnpm-lock.yaml", "go.sum", "cargo.lock", "poetry.lock", "gemfile.lock", "composer.lock", "packed-refs", "orig_head", "fetch_head"}
+	checksumExts   = []string{".css", ".scss", ".less", ".svg", ".map", ".lock", ".sum", ".sha1", ".sha256", ".md5"}
+)
+
+var (
+	uuidRegex     = regexp.MustCompile(`(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+	hexRegex      = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	cssColorRegex = regexp.MustCompile(`^[0-9a-fA-F]{3}([0-9a-fA-F]{3}([0-9a-fA-F]{2})?)?$`)
+)
+
+// shannonEntropy returns the bits of entropy for each character of s
+func shannonEntropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// entropyRatio compares the entropy of the match with the most a random string of the same characters and length can have
+func entropyRatio(match string) float64 {
+	alphabet := 64.0
+	if hexRegex.MatchString(match) {
+		alphabet = 16
+	}
+	length := float64(len(match))
+	if length < alphabet {
+		alphabet = length
+	}
+	if alphabet < 2 {
+		return 0
+	}
+	return shannonEntropy(match) / math.Log2(alphabet)
+}
+
+func containsAny(s string, words []string) string {
+	for _, word := range words {
+		if strings.Contains(s, word) {
+			return word
+		}
+	}
+	return ""
+}
+
+func matchesAny(s string, values []string) bool {
+	for _, value := range values {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scoreFinding returns the confidence from 0 to 100 that the match at loc is a hash, and the reasons for the score
+func scoreFinding(f string, line string, loc []int) (int, []string) {
+	score := baseConfidence
+	var reasons []string
+	add := func(points int, reason string) {
+		score += points
+		reasons = append(reasons, reason)
+	}
+	match := line[loc[0]:loc[1]]
+
+	// Entropy, a hash looks random and a placeholder or a repeated character does not
+	ratio := entropyRatio(match)
+	switch {
+	case ratio < 0.6:
+		add(-30, "low entropy")
+	case ratio < 0.8:
+		add(-10, "medium entropy")
+	case ratio >= 0.9:
+		add(10, "high entropy")
+	}
+
+	// The text around the match, 100 characters before and 20 after
+	start := loc[0] - 100
+	if start < 0 {
+		start = 0
+	}
+	end := loc[1] + 20
+	if end > len(line) {
+		end = len(line)
+	}
+	context := strings.ToLower(line[start:loc[0]] + " " + line[loc[1]:end])
+
+	if word := containsAny(context, hashKeywords); word != "" {
+		add(25, "keyword "+word)
+	}
+	// user:$6$... in a shadow file, or a crypt format that starts with $
+	if (strings.HasSuffix(line[:loc[0]], ":") && strings.HasPrefix(match, "$")) || strings.Contains(context, ":$") {
+		add(15, "shadow format")
+	} else if strings.HasPrefix(match, "$") {
+		add(10, "crypt format")
+	}
+
+	// Known contexts that are not password hashes
+	for _, uuidLoc := range uuidRegex.FindAllStringIndex(line, -1) {
+		if uuidLoc[0] <= loc[0] && loc[1] <= uuidLoc[1] {
+			add(-40, "part of a UUID")
+			break
+		}
+	}
+	if hexRegex.MatchString(match) && len(match) == 40 {
+		if word := containsAny(context, gitKeywords); word != "" {
+			add(-35, "git object id near "+word)
+		}
+	}
+	if loc[0] > 0 && line[loc[0]-1] == '#' && cssColorRegex.MatchString(match) {
+		add(-40, "css colour")
+	}
+	if strings.Contains(context, "integrity") || strings.HasSuffix(strings.ToLower(line[start:loc[0]]), "sha512-") {
+		add(-20, "package integrity")
+	}
+
+	// The file, the last part of the location is the file within an archive
+	name := f
+	if i := strings.LastIndex(name, "!"); i >= 0 {
+		name = name[i+1:]
+	}
+	lowerName := strings.ToLower(name)
+	base := path.Base(strings.ReplaceAll(lowerName, "\\", "/"))
+	ext := path.Ext(base)
+	switch {
+	case strings.Contains("/"+strings.ReplaceAll(lowerName, "\\", "/"), "/.git/"):
+		add(-30, "git directory")
+	case matchesAny(base, checksumFiles) || matchesAny(ext, checksumExts) || strings.HasSuffix(base, ".min.js"):
+		add(-20, "checksum or generated file")
+	case matchesAny(base, hashFiles) || matchesAny(ext, hashExtensions):
+		add(10, "credential file")
+	}
+
+	if score < 0 {
+		score = 0
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score, reasons
+}
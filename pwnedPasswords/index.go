@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+
+The full HIBP range dataset (downloaded with the PwnedPasswordsDownloader for SHA1 and NTLM) is imported into
+one index file for each hash type, offlineFiles/sha1.idx and offlineFiles/ntlm.idx
+
+The index is a header, a fan-out table and the records sorted by hash:
+	magic "PWNIDX1\x00", hash size uint32, record count uint64
+	65537 uint64, the first record of every value of the first 2 bytes of the hash
+	records of the hash (20 bytes SHA1, 16 bytes NTLM) followed by the count uint32, big-endian
+
+A lookup reads the records of the first 2 bytes from the fan-out table and does a binary search, so only a few
+records are read from the disk and the index is never loaded into memory
+
+The downloader writes the hashes sorted, the import checks the order instead of sorting over a billion hashes
+
+**/
+
+const (
+	indexMagic      = "PWNIDX1\x00"
+	indexFanout     = 65536
+	indexHeaderSize = 8 + 4 + 8 + (indexFanout+1)*8
+	countSize       = 4
+)
+
+type HashIndex struct {
+	file     *os.File
+	hashSize int
+	records  uint64
+	fanout   [indexFanout + 1]uint64
+}
+
+// IndexFile returns the location of the index of the hash type in the offline files directory
+func IndexFile(c Configuration, hashType string) string {
+	return filepath.Join(c.OfflineFiles, strings.ToLower(hashType)+".idx")
+}
+
+func OpenHashIndex(f string) (*HashIndex, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, indexHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != indexMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a hash index", f)
+	}
+	ix := &HashIndex{file: file}
+	ix.hashSize = int(binary.BigEndian.Uint32(header[8:]))
+	if ix.hashSize != 20 && ix.hashSize != 16 {
+		file.Close()
+		return nil, fmt.Errorf("%s has hashes of %d bytes, expected SHA1 or NTLM", f, ix.hashSize)
+	}
+	ix.records = binary.BigEndian.Uint64(header[12:])
+	for i := range ix.fanout {
+		ix.fanout[i] = binary.BigEndian.Uint64(header[20+i*8:])
+	}
+	return ix, nil
+}
+
+func (ix *HashIndex) Close() error {
+	return ix.file.Close()
+}
+
+// Lookup returns if the hash is in the index and how many times it was seen in breaches
+func (ix *HashIndex) Lookup(hashInput string) (bool, uint32, error) {
+	target, err := hex.DecodeString(hashInput)
+	if err != nil || len(target) != ix.hashSize {
+		return false, 0, fmt.Errorf("%s is not a hash of %d bytes", hashInput, ix.hashSize)
+	}
+	key := int(target[0])<<8 | int(target[1])
+	low, high := ix.fanout[key], ix.fanout[key+1]
+
+	recordSize := ix.hashSize + countSize
+	record := make([]byte, recordSize)
+	for low < high {
+		middle := low + (high-low)/2
+		if _, err := ix.file.ReadAt(record, int64(indexHeaderSize)+int64(middle)*int64(recordSize)); err != nil {
+			return false, 0, err
+		}
+		switch bytes.Compare(record[:ix.hashSize], target) {
+		case 0:
+			return true, binary.BigEndian.Uint32(record[ix.hashSize:]), nil
+		case -1:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+	return false, 0, nil
+}
+
+// indexWriter writes the records after the space of the header, the header is written when all records are known
+type indexWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	hashSize int
+	records  uint64
+	keys     [indexFanout]uint64
+	last     []byte
+	count    uint64
+}
+
+func (w *indexWriter) add(hash []byte, count uint64) error {
+	if w.hashSize == 0 {
+		w.hashSize = len(hash)
+	}
+	if len(hash) != w.hashSize {
+		return fmt.Errorf("the hash %X has a different length than the hashes before it", hash)
+	}
+	if w.last != nil {
+		switch bytes.Compare(w.last, hash) {
+		case 0:
+			// The same hash twice, the counts are added
+			w.count += count
+			return nil
+		case 1:
+			return fmt.Errorf("the hash %X is not sorted, the import needs the files of the downloader", hash)
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.last = append(w.last[:0], hash...)
+	w.count = count
+	return nil
+}
+
+// flush writes the previous hash, a count larger than uint32 is stored as the maximum
+func (w *indexWriter) flush() error {
+	if w.last == nil {
+		return nil
+	}
+	if _, err := w.writer.Write(w.last); err != nil {
+		return err
+	}
+	var count [countSize]byte
+	binary.BigEndian.PutUint32(count[:], uint32(min(w.count, math.MaxUint32)))
+	if _, err := w.writer.Write(count[:]); err != nil {
+		return err
+	}
+	w.keys[int(w.last[0])<<8|int(w.last[1])]++
+	w.records++
+	if w.records%100000000 == 0 {
+		log.Printf("[*] Imported %d hashes", w.records)
+	}
+	return nil
+}
+
+func (w *indexWriter) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	header := make([]byte, indexHeaderSize)
+	copy(header, indexMagic)
+	binary.BigEndian.PutUint32(header[8:], uint32(w.hashSize))
+	binary.BigEndian.PutUint64(header[12:], w.records)
+	var first uint64
+	for i := 0; i <= indexFanout; i++ {
+		binary.BigEndian.PutUint64(header[20+i*8:], first)
+		if i < indexFanout {
+			first += w.keys[i]
+		}
+	}
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// importLines reads the lines of a downloaded file, the formats are:
+// SUFFIX:COUNT in a file named PREFIX.txt (one file for each prefix), HASH:COUNT (one file) or PREFIX:SUFFIX:COUNT
+func (w *indexWriter) importLines(f string) error {
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	filePrefix := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		var hashText, countText string
+		switch len(parts) {
+		case 3:
+			hashText, countText = parts[0]+parts[1], parts[2]
+		case 2:
+			hashText, countText = parts[0], parts[1]
+			if len(hashText) != 40 && len(hashText) != 32 {
+				hashText = filePrefix + hashText
+			}
+		default:
+			return fmt.Errorf("%s:%d: expected SUFFIX:COUNT, HASH:COUNT or PREFIX:SUFFIX:COUNT", f, lineNumber)
+		}
+		hash, err := hex.DecodeString(hashText)
+		if err != nil || (len(hash) != 20 && len(hash) != 16) {
+			return fmt.Errorf("%s:%d: %s is not a SHA1 or NTLM hash", f, lineNumber, hashText)
+		}
+		count, err := strconv.ParseUint(countText, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid count %s", f, lineNumber, countText)
+		}
+		if err := w.add(hash, count); err != nil {
+			return fmt.Errorf("%s:%d: %v", f, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ImportHashes imports a downloaded file or a directory of files into the index of the hash type in the offline files directory
+// The hash type is the length of the hashes, the index is replaced when the import succeeds
+func ImportHashes(input string, c Configuration) (string, uint64, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return "", 0, err
+	}
+	files := []string{input}
+	if info.IsDir() {
+		entries, err := os.ReadDir(input)
+		if err != nil {
+			return "", 0, err
+		}
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".txt") {
+				files = append(files, filepath.Join(input, entry.Name()))
+			}
+		}
+		// The prefixes are in upper-case, sorting the names sorts the hashes
+		sort.Slice(files, func(i, j int) bool {
+			return strings.ToUpper(filepath.Base(files[i])) < strings.ToUpper(filepath.Base(files[j]))
+		})
+	}
+	if len(files) == 0 {
+		return "", 0, errors.New("no .txt files to import in " + input)
+	}
+
+	tmp := filepath.Join(c.OfflineFiles, "import.idx.tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	w := &indexWriter{file: file, writer: bufio.NewWriterSize(file, 1024*1024)}
+	// The header is written last
+	if _, err := w.writer.Write(make([]byte, indexHeaderSize)); err != nil {
+		file.Close()
+		return "", 0, err
+	}
+	for _, f := range files {
+		if err := w.importLines(f); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return "", 0, err
+		}
+	}
+	if err := w.close(); err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	// An empty index would replace the index of the SHA1 hashes and every lookup would fail
+	if w.records == 0 {
+		os.Remove(tmp)
+		return "", 0, errors.New("no hashes to import in " + input)
+	}
+
+	hashType := "SHA1"
+	if w.hashSize == 16 {
+		hashType = "NTLM"
+	}
+	output := IndexFile(c, hashType)
+	if err := os.Rename(tmp, output); err != nil {
+		return "", 0, err
+	}
+	return output, w.records, nil
+}
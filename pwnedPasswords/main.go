@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -60,10 +62,11 @@ type HashOfflineLookupStruct struct {
 }
 
 type PrefixStruct struct {
-	Prefix      string   `json:"prefix"`
-	Suffix      []string `json:"suffix"`
-	Created     string   `json:"created"`
-	LastUpdated string   `json:"lastUpdated"`
+	Prefix      string         `json:"prefix"`
+	Suffix      []string       `json:"suffix"`
+	Counts      map[string]int `json:"counts,omitempty"` // Times each suffix was seen in breaches, offline files saved before the counts were kept do not have them
+	Created     string         `json:"created"`
+	LastUpdated string         `json:"lastUpdated"`
 }
 
 func (c *Configuration) CreateConfig() error {
@@ -266,8 +269,20 @@ func removeDuplicateSuffix(suffix []string) []string {
 	return result
 }
 
+// mergeCounts updates the counts of the offline file with the counts from the API
+func mergeCounts(counts map[string]int, newCounts map[string]int) map[string]int {
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+	for suffix, count := range newCounts {
+		counts[suffix] = count
+	}
+	return counts
+}
+
 // CheckPassword checks if the password has been pwned using HIBP API
-func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
+// The count is the number of times the hash was seen in breaches
+func CheckHash(hashInput string, c Configuration) (bool, error, bool, int) {
 	// Skip the verification of a self-signed certificate
 	// Only connect if TLS1.2 or TLS1.3 is negotiated with a provided cipher
 	tr := &http.Transport{
@@ -288,6 +303,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 	var hashType string
 	foundHash := false
 	foundHashOffline := false
+	count := 0
 	//log.Println(hashInput)
 	hashPrefix := hashInput[:5]
 	suffix := hashInput[5:]
@@ -307,6 +323,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 				for _, suffixOffline := range prefix.Suffix {
 					if strings.ToUpper(suffixOffline) == strings.ToUpper(suffix) && !foundHash {
 						foundHash = true
+						count = prefix.Counts[strings.ToUpper(suffix)]
 					}
 				}
 			}
@@ -319,6 +336,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 				for _, suffixOffline := range prefix.Suffix {
 					if strings.ToUpper(suffixOffline) == strings.ToUpper(suffix) && !foundHash {
 						foundHash = true
+						count = prefix.Counts[strings.ToUpper(suffix)]
 					}
 				}
 			}
@@ -326,7 +344,19 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 	}
 
 	// Verify that hashes are found in the offline file struct
-	if foundHash {
+	// An offline file saved before the counts were kept is updated from the API to get the count,
+	// without a connection the hash is still reported as found with an unknown count
+	offlineWithoutCount := foundHash && count == 0
+	apiError := func(err error) (bool, error, bool, int) {
+		if offlineWithoutCount {
+			log.Printf("[W] Unable to get the count from the HIBP API: %v", err)
+			return true, nil, true, 0
+		}
+		return false, err, false, 0
+	}
+	if offlineWithoutCount {
+		foundHash = false
+	} else if foundHash {
 		//	fmt.Println("[*] Found hash in an offline file...")
 		foundHashOffline = true
 	}
@@ -335,21 +365,21 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 	if !foundHash {
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			return false, err, false
+			return apiError(err)
 		}
 		req.Header.Set("User-Agent", c.UserAgent)
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 		resp, err := client.Do(req)
 		if err != nil {
-			return false, err, false
+			return apiError(err)
 		}
 		defer resp.Body.Close()
 		// Put in the delay
 		time.Sleep(time.Duration(c.RequestsDelay) * time.Second)
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return false, err, false
+			return apiError(err)
 		}
 		//fmt.Printf("%s\n\n", string(body))
 		hashes := strings.Split(string(body), "\n")
@@ -358,6 +388,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 		currentTime := time.Now()
 		formattedTime := currentTime.Format("2006-01-02 15:04:05")
 		prefix.Created = formattedTime
+		prefix.Counts = make(map[string]int)
 
 		for _, h := range hashes {
 			parts := strings.Split(h, ":")
@@ -365,9 +396,15 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 			if len(parts) < 2 {
 				continue
 			}
+			// Each line is SUFFIX:COUNT
+			seen, err := strconv.Atoi(RemoveBadChars(parts[1]))
+			if err == nil {
+				prefix.Counts[strings.ToUpper(parts[0])] = seen
+			}
 			if strings.ToUpper(parts[0]) == suffix {
 				//return true, nil
 				foundHash = true
+				count = seen
 			}
 		}
 		// Populate the offlineStruct
@@ -379,6 +416,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 					prefixExists = true
 					HashStruct.SHA1HashPrefix[i].Suffix = append(HashStruct.SHA1HashPrefix[i].Suffix, prefix.Suffix...)
 					HashStruct.SHA1HashPrefix[i].Suffix = removeDuplicateSuffix(HashStruct.SHA1HashPrefix[i].Suffix)
+					HashStruct.SHA1HashPrefix[i].Counts = mergeCounts(HashStruct.SHA1HashPrefix[i].Counts, prefix.Counts)
 					currentTime := time.Now()
 					// Update the Last Updated Time Stamp in the Struct
 					formattedTime := currentTime.Format("2006-01-02 15:04:05")
@@ -397,6 +435,7 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 					prefixExists = true
 					HashStruct.NTLMHashPrefix[i].Suffix = append(HashStruct.NTLMHashPrefix[i].Suffix, prefix.Suffix...)
 					HashStruct.NTLMHashPrefix[i].Suffix = removeDuplicateSuffix(HashStruct.NTLMHashPrefix[i].Suffix)
+					HashStruct.NTLMHashPrefix[i].Counts = mergeCounts(HashStruct.NTLMHashPrefix[i].Counts, prefix.Counts)
 					currentTime := time.Now()
 					// Update the Last Updated Time Stamp in the Struct
 					formattedTime := currentTime.Format("2006-01-02 15:04:05")
@@ -411,12 +450,63 @@ func CheckHash(hashInput string, c Configuration) (bool, error, bool) {
 	}
 
 	if foundHash && foundHashOffline {
-		return true, nil, true
+		return true, nil, true, count
 	} else if foundHash && !foundHashOffline {
-		return true, nil, false
+		return true, nil, false, count
 	}
 
-	return false, nil, false
+	return false, nil, false, 0
+}
+
+// PrevalenceSummary counts the checked hashes by how often they were seen in breaches
+type PrevalenceSummary struct {
+	Threshold int
+	NotFound  int
+	Once      int
+	Below     int // Seen more than once and less than the threshold
+	Common    int // Seen at least the threshold
+	Unknown   int // Found in an offline file without a count
+}
+
+// Report prints the result of the hash, a hash seen at least the threshold is marked with [!]
+func (p *PrevalenceSummary) Report(hashInput string, pwned bool, source string, count int) {
+	if !pwned {
+		p.NotFound++
+		fmt.Printf("[-] Password Hash Not Available: %s\n", hashInput)
+		return
+	}
+
+	marker := "[+]"
+	seen := fmt.Sprintf("Seen %d times", count)
+	switch {
+	case count == 0:
+		p.Unknown++
+		seen = "Seen an unknown number of times"
+	case p.Threshold > 0 && count >= p.Threshold:
+		p.Common++
+		marker = "[!]"
+		seen = fmt.Sprintf("Seen %d times, at least %d", count, p.Threshold)
+	case count == 1:
+		p.Once++
+		seen = "Seen once"
+	default:
+		p.Below++
+	}
+	fmt.Printf("%s Password Hash Exists in %s: %s (%s)\n", marker, source, hashInput, seen)
+}
+
+func (p *PrevalenceSummary) Print() {
+	fmt.Printf("\n[*] Not found: %d\n", p.NotFound)
+	fmt.Printf("[*] Seen once: %d\n", p.Once)
+	if p.Threshold > 0 {
+		fmt.Printf("[*] Seen more than once and less than %d times: %d\n", p.Threshold, p.Below)
+		fmt.Printf("[*] Seen at least %d times: %d\n", p.Threshold, p.Common)
+	} else {
+		fmt.Printf("[*] Seen more than once: %d\n", p.Below)
+	}
+	if p.Unknown > 0 {
+		fmt.Printf("[*] Seen an unknown number of times: %d\n", p.Unknown)
+	}
 }
 
 func LoadOfflineFiles(c Configuration, hashType string) {
@@ -466,6 +556,9 @@ func LoadOfflineFiles(c Configuration, hashType string) {
 // create the struct where the hashes are stored to be global
 var HashStruct HashOfflineLookupStruct
 
+// The local indexes of the full dataset by hash type
+var HashIndexes = make(map[string]*HashIndex)
+
 func main() {
 	var config Configuration
 	ConfigPtr := flag.String("config", "config.json", "Configuration file to load")
@@ -473,6 +566,8 @@ func main() {
 	ReadFilePtr := flag.String("f", "", "File to load and read line-by-line that contains SHA1 or NTLM hashes")
 	SHA1FilePtr := flag.String("sha1", "", "File to load and read plain-text passwords and convert into SHA1 hashes")
 	NTLMFilePtr := flag.String("ntlm", "", "File to load and read plain-text passwords and convert into NTLM hashes")
+	ImportPtr := flag.String("import", "", "Import the downloaded HIBP range file or directory (SHA1 or NTLM) into the local index")
+	ThresholdPtr := flag.Int("threshold", 0, "Mark the hashes seen in breaches at least this many times as common (0 to disable)")
 	flag.Parse()
 
 	log.Println("Loading the following config file: " + *ConfigPtr + "\n")
@@ -487,6 +582,28 @@ func main() {
 	cf.CreateDirectory("/" + config.OfflineFiles + "/sha1")
 	cf.CreateDirectory("/" + config.OfflineFiles + "/ntlm")
 
+	if len(*ImportPtr) > 0 {
+		fmt.Printf("[*] Importing: %s\n", *ImportPtr)
+		indexFile, records, err := ImportHashes(*ImportPtr, config)
+		if err != nil {
+			log.Fatalf("[E] Unable to import the hashes: %v\n", err)
+		}
+		fmt.Printf("[*] Imported %d hashes into %s\n", records, indexFile)
+		return
+	}
+
+	// The local index of the full dataset is used instead of the API and the offline files
+	for _, hashType := range []string{"SHA1", "NTLM"} {
+		index, err := OpenHashIndex(IndexFile(config, hashType))
+		if err == nil {
+			log.Printf("Using the local index for %s hashes with %d hashes\n", hashType, index.records)
+			HashIndexes[hashType] = index
+			defer index.Close()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[W] Unable to open the local index: %v", err)
+		}
+	}
+
 	// Load the offline files into the struct
 	if !config.SkipLoadOfflineFiles {
 		LoadOfflineFiles(config, "SHA1")
@@ -509,26 +626,40 @@ func main() {
 
 	// Load offline hash files
 
+	summary := PrevalenceSummary{Threshold: *ThresholdPtr}
 	for _, hashInput := range inputHashes {
 		// If the hash is not upper-case the offline storage stores the prefix in lower-case...
 		hashInput = strings.ToUpper(hashInput)
 		//log.Println(hashInput)
-		pwned, err, foundHashOffline := CheckHash(hashInput, config)
+		hashType := "SHA1"
+		if len(hashInput) == 32 {
+			hashType = "NTLM"
+		}
+		if index, found := HashIndexes[hashType]; found {
+			pwned, count, err := index.Lookup(hashInput)
+			if err != nil {
+				fmt.Printf("Error checking password: %v\n", err)
+				continue
+			}
+			summary.Report(hashInput, pwned, "Local Index", int(count))
+			continue
+		}
+
+		pwned, err, foundHashOffline, count := CheckHash(hashInput, config)
 		if err != nil {
 			fmt.Printf("Error checking password: %v\n", err)
 			return
 		}
 
-		if pwned && foundHashOffline {
-			fmt.Printf("[+] Password Hash Exists in Offline Files: %s\n", hashInput)
-		} else if pwned && !foundHashOffline {
-			fmt.Printf("[+] Password Hash Exists in HIBP API: %s\n", hashInput)
+		if foundHashOffline {
+			summary.Report(hashInput, pwned, "Offline Files", count)
 		} else {
-			fmt.Printf("[-] Password Hash Not Available: %s\n", hashInput)
+			summary.Report(hashInput, pwned, "HIBP API", count)
 		}
 	}
 
 	if len(inputHashes) > 0 {
+		summary.Print()
 		fmt.Println("\nCompleted the analysis...")
 		// Save new offline database struct
 		if !config.SkipSaveOfflineFiles {
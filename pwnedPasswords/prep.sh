@@ -16,5 +16,5 @@ go get github.com/thepcn3rd/goAdvsCommonFunctions
 go get golang.org/x/text/encoding/unicode
 go get golang.org/x/crypto/md4
 
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" main.go
-#GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" main.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $bin -ldflags "-w -s" .
+#GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" .